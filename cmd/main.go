@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"os"
 	"os/signal"
 	"syscall"
 	"vgo-balancer/pkg/config"
@@ -21,7 +22,7 @@ func main() {
 	defer logger.Sync()
 
 	// Load the configuration file.
-	config, err := config.NewConfig(*configPath)
+	cfg, err := config.NewConfig(*configPath)
 	if err != nil {
 		logger.Fatal("failed to load configuration file", zap.Error(err))
 	}
@@ -32,9 +33,34 @@ func main() {
 	defer stop()
 
 	// Start the Server.
-	server := server.NewServer(ctx, logger, config)
-	go server.Start()
+	server := server.NewServer(ctx, logger, cfg)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Start()
+	}()
 
-	<-ctx.Done()
-	logger.Info("Load Balancer Shutdown gracefully.")
+	// Reload the backends and weights on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			cfg, err := config.NewConfig(*configPath)
+			if err != nil {
+				logger.Error("failed to reload configuration file", zap.Error(err))
+				continue
+			}
+			server.Reload(cfg)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// Wait for the requests in flight.
+		if err := <-stopped; err != nil {
+			logger.Fatal("Load Balancer failed.", zap.Error(err))
+		}
+		logger.Info("Load Balancer Shutdown gracefully.")
+	case err := <-stopped:
+		logger.Fatal("Load Balancer failed.", zap.Error(err))
+	}
 }
@@ -1,12 +1,16 @@
 module vgo-balancer
 
-go 1.23.1
+go 1.24.0
 
 require (
 	github.com/spf13/cast v1.7.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.44.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+)
@@ -0,0 +1,276 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/service"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the admin API
+const (
+	DefaultHost = "127.0.0.1"
+	// DefaultMinHealthyBackends is the healthy backends every service needs for the balancer to be ready.
+	DefaultMinHealthyBackends = 1
+)
+
+// Registry gives the admin API access to the registered services and the state of the balancer.
+type Registry interface {
+	Services() []*service.Service                 // Services returns the services ordered by name.
+	Service(name string) (*service.Service, bool) // Service returns the service with the name.
+	Started() bool                                // Started reports whether the balancer accepts traffic.
+	Draining() bool                               // Draining reports whether the balancer is shutting down.
+}
+
+// Server serves the admin API, on a listener separate from the traffic.
+type Server struct {
+	registry   Registry
+	minHealthy int
+	token      string // token is required by the requests changing the state, when set.
+	logger     *zap.Logger
+	mux        *http.ServeMux
+}
+
+// ServiceStatus is the status of a service returned by the admin API.
+type ServiceStatus struct {
+	Name        string                  `json:"name"`
+	Mode        string                  `json:"mode"`
+	Maintenance bool                    `json:"maintenance"`
+	Backends    []service.BackendHealth `json:"backends"`
+}
+
+// MaintenanceStatus is the maintenance mode of a service, read and set through the admin API.
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// PurgeResult is the response of a cache purge.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// Readiness is the response of the readiness endpoint.
+type Readiness struct {
+	Ready    bool               `json:"ready"`
+	Started  bool               `json:"started"`
+	Draining bool               `json:"draining"`
+	Services []ServiceReadiness `json:"services"`
+}
+
+// ServiceReadiness is the readiness of a service, ready with enough healthy backends.
+type ServiceReadiness struct {
+	Name            string `json:"name"`
+	Ready           bool   `json:"ready"`
+	HealthyBackends int    `json:"healthy_backends"`
+	TotalBackends   int    `json:"total_backends"`
+}
+
+func NewServer(registry Registry, cfg *config.Admin, logger *zap.Logger) *Server {
+	a := &Server{
+		registry:   registry,
+		minHealthy: cfg.MinHealthyBackends,
+		token:      cfg.Token,
+		logger:     logger,
+		mux:        http.NewServeMux(),
+	}
+	if a.minHealthy == 0 {
+		a.minHealthy = DefaultMinHealthyBackends
+	}
+	a.mux.HandleFunc("GET /healthz", a.healthz)
+	a.mux.HandleFunc("GET /readyz", a.readyz)
+	a.mux.HandleFunc("GET /services", a.listServices)
+	a.mux.HandleFunc("GET /services/{name}", a.getService)
+	a.mux.HandleFunc("GET /services/{name}/backends", a.getBackends)
+	a.mux.HandleFunc("GET /services/{name}/maintenance", a.getMaintenance)
+	a.mux.HandleFunc("PUT /services/{name}/maintenance", a.authorized(a.setMaintenance))
+	a.mux.HandleFunc("GET /services/{name}/cache", a.getCache)
+	a.mux.HandleFunc("DELETE /services/{name}/cache", a.authorized(a.purgeCache))
+	return a
+}
+
+// authorized requires the token of the admin API, if any, as a bearer token.
+func (a *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token != "" && (!ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the admin API on the address until the context is done.
+func (a *Server) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:     a,
+		ReadTimeout: 15 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	a.logger.Info("Starting admin API", zap.String("address", addr))
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// healthz reports that the process is alive.
+func (a *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the balancer can take traffic: it is started and not draining, and
+// every service has enough healthy backends.
+func (a *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{
+		Started:  a.registry.Started(),
+		Draining: a.registry.Draining(),
+	}
+	readiness.Ready = readiness.Started && !readiness.Draining
+	for _, svc := range a.registry.Services() {
+		healthy, total := svc.HealthyBackends()
+		ready := healthy >= a.minHealthy
+		readiness.Services = append(readiness.Services, ServiceReadiness{
+			Name:            svc.Name,
+			Ready:           ready,
+			HealthyBackends: healthy,
+			TotalBackends:   total,
+		})
+		readiness.Ready = readiness.Ready && ready
+	}
+
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
+
+func (a *Server) listServices(w http.ResponseWriter, r *http.Request) {
+	services := a.registry.Services()
+	status := make([]ServiceStatus, 0, len(services))
+	for _, svc := range services {
+		status = append(status, serviceStatus(svc))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *Server) getService(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.registry.Service(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, serviceStatus(svc))
+}
+
+func (a *Server) getBackends(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.registry.Service(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, svc.HealthStatus())
+}
+
+func (a *Server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.registry.Service(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, MaintenanceStatus{Enabled: svc.InMaintenance()})
+}
+
+// setMaintenance puts a service in or out of maintenance, e.g. {"enabled": true}.
+func (a *Server) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.registry.Service(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	var status MaintenanceStatus
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&status); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body, expected {\"enabled\": true|false}")
+		return
+	}
+	svc.SetMaintenance(status.Enabled)
+	a.logger.Info("Maintenance mode set through the admin API", zap.String("service", svc.Name), zap.Bool("maintenance", status.Enabled), zap.String("remote_addr", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, MaintenanceStatus{Enabled: svc.InMaintenance()})
+}
+
+func (a *Server) getCache(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.serviceCache(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, svc.Cache.Stats())
+}
+
+// purgeCache removes the cached responses of a service, only those whose path starts with the
+// prefix query parameter when set, e.g. DELETE /services/api/cache?prefix=/api/users
+func (a *Server) purgeCache(w http.ResponseWriter, r *http.Request) {
+	svc, ok := a.serviceCache(w, r)
+	if !ok {
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	purged := svc.Cache.Purge(prefix)
+	a.logger.Info("Cache purged through the admin API", zap.String("service", svc.Name), zap.String("prefix", prefix), zap.Int("purged", purged), zap.String("remote_addr", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, PurgeResult{Purged: purged})
+}
+
+// serviceCache returns the service of the request, answering with an error when it has no cache.
+func (a *Server) serviceCache(w http.ResponseWriter, r *http.Request) (*service.Service, bool) {
+	svc, ok := a.registry.Service(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "service not found")
+		return nil, false
+	}
+	if svc.Cache == nil {
+		writeError(w, http.StatusNotFound, "service has no cache")
+		return nil, false
+	}
+	return svc, true
+}
+
+func serviceStatus(svc *service.Service) ServiceStatus {
+	return ServiceStatus{
+		Name:        svc.Name,
+		Mode:        svc.Mode,
+		Maintenance: svc.InMaintenance(),
+		Backends:    svc.HealthStatus(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/service"
+
+	"go.uber.org/zap"
+)
+
+// registry is a fixed set of services.
+type registry struct {
+	services map[string]*service.Service
+	started  bool
+	draining bool
+}
+
+func (r *registry) Services() []*service.Service {
+	var services []*service.Service
+	for _, svc := range r.services {
+		services = append(services, svc)
+	}
+	return services
+}
+
+func (r *registry) Service(name string) (*service.Service, bool) {
+	svc, ok := r.services[name]
+	return svc, ok
+}
+
+func (r *registry) Started() bool  { return r.started }
+func (r *registry) Draining() bool { return r.draining }
+
+// newTestServer creates an admin API with the token over a web service, and returns it with the
+// service.
+func newTestServer(t *testing.T, token string) (*Server, *service.Service) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	svc, err := service.NewService(&config.Service{
+		Name:     "web",
+		Backends: []config.Backend{{URL: "http://127.0.0.1:1"}},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &registry{services: map[string]*service.Service{"web": svc}, started: true}
+	return NewServer(reg, &config.Admin{Token: token}, zap.NewNop()), svc
+}
+
+func TestMaintenanceToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"missing token", "change-me", "", http.StatusUnauthorized},
+		{"wrong token", "change-me", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", "change-me", "change-me", http.StatusUnauthorized},
+		{"basic credentials", "change-me", "Basic Y2hhbmdlLW1lOg==", http.StatusUnauthorized},
+		{"token", "change-me", "Bearer change-me", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, svc := newTestServer(t, tt.token)
+			r := httptest.NewRequest(http.MethodPut, "/services/web/maintenance", strings.NewReader(`{"enabled": true}`))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized {
+				if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+					t.Errorf("WWW-Authenticate = %q, want Bearer", got)
+				}
+				if svc.InMaintenance() {
+					t.Error("maintenance set without the token")
+				}
+				return
+			}
+			if !svc.InMaintenance() {
+				t.Error("maintenance not set")
+			}
+		})
+	}
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	a, svc := newTestServer(t, "change-me")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer change-me")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+	maintenance := func(w *httptest.ResponseRecorder) bool {
+		t.Helper()
+		var status MaintenanceStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status.Enabled
+	}
+
+	// Reads don't need the token.
+	r := httptest.NewRequest(http.MethodGet, "/services/web/maintenance", nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || maintenance(w) {
+		t.Fatalf("GET maintenance = %d, want 200 and disabled", w.Code)
+	}
+
+	if w := do(http.MethodPut, "/services/web/maintenance", `{"enabled": true}`); w.Code != http.StatusOK || !maintenance(w) {
+		t.Errorf("PUT enabled = %d, want 200 and enabled", w.Code)
+	}
+	if w := do(http.MethodGet, "/services/web", ""); !strings.Contains(w.Body.String(), `"maintenance": true`) {
+		t.Errorf("service status %s doesn't report the maintenance", w.Body.String())
+	}
+	if w := do(http.MethodPut, "/services/web/maintenance", `{"enabled": false}`); w.Code != http.StatusOK || maintenance(w) || svc.InMaintenance() {
+		t.Errorf("PUT disabled = %d, want 200 and disabled", w.Code)
+	}
+
+	invalid := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"invalid body", http.MethodPut, "/services/web/maintenance", `enabled`, http.StatusBadRequest},
+		{"oversized body", http.MethodPut, "/services/web/maintenance", `{"enabled": true, "x": "` + strings.Repeat("a", 2048) + `"}`, http.StatusBadRequest},
+		{"unknown service", http.MethodPut, "/services/api/maintenance", `{"enabled": true}`, http.StatusNotFound},
+		{"unknown service read", http.MethodGet, "/services/api/maintenance", "", http.StatusNotFound},
+		{"method not allowed", http.MethodPost, "/services/web/maintenance", `{"enabled": true}`, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if svc.InMaintenance() {
+				t.Error("maintenance set by an invalid request")
+			}
+		})
+	}
+}
+
+func TestPurgeCacheToken(t *testing.T) {
+	a, _ := newTestServer(t, "change-me")
+	r := httptest.NewRequest(http.MethodDelete, "/services/web/cache", nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
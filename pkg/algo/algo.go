@@ -1,6 +1,7 @@
 package algo
 
 import (
+	"math/rand/v2"
 	"net/http"
 	bc "vgo-balancer/pkg/backend"
 )
@@ -10,17 +11,9 @@ type Algorithm interface {
 	Name() string
 }
 
-func CreateAlgorithm(name string, pool []*bc.Backend) Algorithm {
-	switch name {
-	case "round-robin":
-		return &RoundRobin{}
-	case "weighted-round-robin":
-		return NewWeightedRoundRobin(pool)
-	case "ip-hash":
-		return &IPHash{}
-	case "least-response-time":
-		return &LeastResponseTime{}
-	default:
-		return &RoundRobin{} // default algorithm
-	}
+// admit reports whether a backend takes the request. Backends warming up after a slow start
+// only take a share of the requests matching their warm-up factor.
+func admit(b *bc.Backend) bool {
+	f := b.WarmupFactor()
+	return f >= 1 || rand.Float64() < f
 }
@@ -0,0 +1,176 @@
+package algo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	bc "vgo-balancer/pkg/backend"
+)
+
+func init() {
+	Register("hash", func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		var o HashOptions
+		if err := opts.Decode(&o); err != nil {
+			return nil, err
+		}
+		return NewHash(o)
+	})
+}
+
+// Supported hash key sources
+const (
+	HashSourceHeader   = "header"
+	HashSourceCookie   = "cookie"
+	HashSourceQuery    = "query"
+	HashSourcePath     = "path"
+	HashSourceIP       = "ip"
+	HashFallbackRandom = "random"
+)
+
+// HashOptions are the lb_options of the hash algorithm.
+type HashOptions struct {
+	Key      []string `yaml:"key"`      // The parts of the hash key. e.g. header:X-Tenant-Id, cookie:session, query:tenant, path, ip
+	Fallback []string `yaml:"fallback"` // The key used when a part of the key is absent, or random. default is ip.
+}
+
+type hashSource struct {
+	kind string
+	name string
+}
+
+// Hash pins requests with the same key to the same backend. The key is built from request
+// headers, cookies, query parameters, the path or the client IP. Backends are chosen by weighted
+// rendezvous hashing, so only the keys of a backend that goes down or warms up move elsewhere.
+type Hash struct {
+	key      []hashSource
+	fallback []hashSource // nil picks a random backend.
+}
+
+func NewHash(o HashOptions) (*Hash, error) {
+	if len(o.Key) == 0 {
+		return nil, fmt.Errorf("hash requires a key")
+	}
+	key, err := parseHashSources(o.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hash{key: key}
+	switch {
+	case len(o.Fallback) == 0:
+		h.fallback = []hashSource{{kind: HashSourceIP}}
+	case len(o.Fallback) == 1 && o.Fallback[0] == HashFallbackRandom:
+		h.fallback = nil
+	default:
+		if h.fallback, err = parseHashSources(o.Fallback); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func parseHashSources(specs []string) ([]hashSource, error) {
+	sources := make([]hashSource, 0, len(specs))
+	for _, spec := range specs {
+		kind, name, _ := strings.Cut(spec, ":")
+		switch kind {
+		case HashSourceHeader, HashSourceCookie, HashSourceQuery:
+			if name == "" {
+				return nil, fmt.Errorf("hash key %q requires a name, e.g. %s:name", spec, kind)
+			}
+		case HashSourcePath, HashSourceIP:
+		default:
+			return nil, fmt.Errorf("unsupported hash key %q", spec)
+		}
+		sources = append(sources, hashSource{kind: kind, name: name})
+	}
+	return sources, nil
+}
+
+func (h *Hash) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	key, ok := hashKey(h.key, r)
+	if !ok && h.fallback != nil {
+		key, ok = hashKey(h.fallback, r)
+	}
+	if !ok {
+		return pickRandom(pool)
+	}
+
+	var selected *bc.Backend
+	var best float64
+	for _, b := range pool {
+		if !b.IsAlive.Load() {
+			continue
+		}
+		if score := rendezvousScore(key, b); selected == nil || score > best {
+			selected = b
+			best = score
+		}
+	}
+	return selected
+}
+
+func (h *Hash) Name() string {
+	return "hash"
+}
+
+// hashKey joins the values of the sources. ok is false when one of them is absent.
+func hashKey(sources []hashSource, r *http.Request) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+
+	parts := make([]string, 0, len(sources))
+	for _, src := range sources {
+		var value string
+		switch src.kind {
+		case HashSourceHeader:
+			value = r.Header.Get(src.name)
+		case HashSourceCookie:
+			if c, err := r.Cookie(src.name); err == nil {
+				value = c.Value
+			}
+		case HashSourceQuery:
+			value = r.URL.Query().Get(src.name)
+		case HashSourcePath:
+			value = r.URL.Path
+		case HashSourceIP:
+			value = getClientIP(r)
+		}
+		if value == "" {
+			return "", false
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+// rendezvousScore is the weighted rendezvous score of a backend for a key.
+func rendezvousScore(key string, b *bc.Backend) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(b.URL.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	// Map the hash to (0, 1) and weight it, -w/ln(u) is larger for heavier backends.
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(max(b.EffectiveWeight(), 1)) / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, spreading the FNV hash over all the bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+var globalRandom = &Random{src: &RandomSource{}}
+
+func pickRandom(pool []*bc.Backend) *bc.Backend {
+	return globalRandom.NextBackend(pool, nil, nil)
+}
@@ -0,0 +1,153 @@
+package algo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	bc "vgo-balancer/pkg/backend"
+)
+
+func newTestHash(t *testing.T, o HashOptions) *Hash {
+	t.Helper()
+	h, err := NewHash(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func tenantRequest(tenant string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant-Id", tenant)
+	return r
+}
+
+// assign returns the backend of n tenants.
+func assign(h *Hash, pool []*bc.Backend, n int) []*bc.Backend {
+	backends := make([]*bc.Backend, n)
+	for i := range backends {
+		backends[i] = h.NextBackend(pool, nil, tenantRequest(fmt.Sprintf("tenant-%d", i)))
+	}
+	return backends
+}
+
+func TestHashStableOnPoolChange(t *testing.T) {
+	h := newTestHash(t, HashOptions{Key: []string{"header:X-Tenant-Id"}})
+	pool := newTestPool(1, 1, 1, 1, 1)
+	const n = 5000
+	before := assign(h, pool, n)
+
+	// A new backend only takes keys, about its share of them.
+	grown := append(append([]*bc.Backend(nil), pool...), newTestPool(1)[0])
+	grown[5].URL.Host = "backend-5"
+	moved := 0
+	for i, b := range assign(h, grown, n) {
+		if b != before[i] {
+			moved++
+			if b != grown[5] {
+				t.Fatalf("tenant-%d moved from %s to %s, an existing backend", i, before[i].URL, b.URL)
+			}
+		}
+	}
+	if share := float64(moved) / n; share < 0.12 || share > 0.21 {
+		t.Errorf("%.3f of the keys moved to the new backend, want about 1/6", share)
+	}
+
+	// A backend going down only loses its own keys.
+	pool[2].IsAlive.Store(false)
+	for i, b := range assign(h, pool, n) {
+		if before[i] != pool[2] && b != before[i] {
+			t.Fatalf("tenant-%d moved from %s to %s", i, before[i].URL, b.URL)
+		}
+		if b == pool[2] {
+			t.Fatalf("tenant-%d sent to the dead backend", i)
+		}
+	}
+}
+
+func TestHashWeights(t *testing.T) {
+	h := newTestHash(t, HashOptions{Key: []string{"header:X-Tenant-Id"}})
+	pool := newTestPool(1, 3)
+	const n = 10000
+
+	counts := map[*bc.Backend]int{}
+	for _, b := range assign(h, pool, n) {
+		counts[b]++
+	}
+	if share := float64(counts[pool[1]]) / n; share < 0.72 || share > 0.78 {
+		t.Errorf("heavier backend got %.3f of the keys, want 0.75", share)
+	}
+}
+
+func TestHashKeySources(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/orders?tenant=acme", nil)
+	r.Header.Set("X-Tenant-Id", "acme")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	tests := []struct {
+		key    []string
+		want   string
+		wantOK bool
+	}{
+		{[]string{"header:X-Tenant-Id"}, "acme", true},
+		{[]string{"cookie:session"}, "s1", true},
+		{[]string{"query:tenant"}, "acme", true},
+		{[]string{"path"}, "/api/orders", true},
+		{[]string{"ip"}, "192.0.2.1", true},
+		{[]string{"header:X-Tenant-Id", "path"}, "acme\x00/api/orders", true},
+		{[]string{"header:X-Missing"}, "", false},
+		{[]string{"path", "cookie:missing"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.key, ","), func(t *testing.T) {
+			sources, err := parseHashSources(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := hashKey(sources, r); got != tt.want || ok != tt.wantOK {
+				t.Errorf("hashKey = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHashFallback(t *testing.T) {
+	pool := newTestPool(1, 1, 1, 1, 1, 1, 1, 1)
+	byIP := func(h *Hash) map[*bc.Backend]bool {
+		picked := map[*bc.Backend]bool{}
+		for i := 0; i < 50; i++ {
+			picked[h.NextBackend(pool, nil, httptest.NewRequest(http.MethodGet, "/", nil))] = true
+		}
+		return picked
+	}
+
+	// Requests without the key are hashed by client IP by default.
+	if picked := byIP(newTestHash(t, HashOptions{Key: []string{"header:X-Tenant-Id"}})); len(picked) != 1 {
+		t.Errorf("requests of a client spread over %d backends, want 1", len(picked))
+	}
+	if picked := byIP(newTestHash(t, HashOptions{Key: []string{"header:X-Tenant-Id"}, Fallback: []string{"random"}})); len(picked) < 2 {
+		t.Errorf("random fallback picked %d backends, want several", len(picked))
+	}
+}
+
+func TestNewHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		options HashOptions
+		wantErr string
+	}{
+		{"no key", HashOptions{}, "hash requires a key"},
+		{"no name", HashOptions{Key: []string{"header"}}, "requires a name"},
+		{"unknown source", HashOptions{Key: []string{"body"}}, "unsupported hash key"},
+		{"invalid fallback", HashOptions{Key: []string{"path"}, Fallback: []string{"cookie"}}, "requires a name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewHash(tt.options); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
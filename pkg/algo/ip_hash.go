@@ -3,10 +3,14 @@ package algo
 import (
 	"hash/fnv"
 	"net/http"
-	"strings"
 	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/realip"
 )
 
+func init() {
+	Register("ip-hash", noOptions(func(pool []*bc.Backend) Algorithm { return &IPHash{} }))
+}
+
 type IPHash struct{}
 
 func (i *IPHash) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
@@ -26,10 +30,20 @@ func (i *IPHash) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.
 	}
 
 	clientIP := getClientIP(r)
+	if clientIP == "" {
+		return pickRandom(availablePool)
+	}
 	hash := fnv.New32a()
 	hash.Write([]byte(clientIP))
-	index := hash.Sum32() % uint32(len(availablePool))
+	index := int(hash.Sum32() % uint32(len(availablePool)))
 
+	// Requests a warming up backend doesn't take go to the next backend of the pool.
+	for i := 0; i < len(availablePool); i++ {
+		b := availablePool[(index+i)%len(availablePool)]
+		if admit(b) {
+			return b
+		}
+	}
 	return availablePool[index]
 }
 
@@ -37,13 +51,11 @@ func (i *IPHash) Name() string {
 	return "ip-hash"
 }
 
+// getClientIP returns the client IP resolved by the server from the trusted proxies, or an
+// empty string when there is no request, e.g. for tcp services.
 func getClientIP(r *http.Request) string {
-	ip := r.Header.Get("X-Real-IP")
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
-	}
-	if ip == "" {
-		ip = strings.Split(r.RemoteAddr, ":")[0]
+	if r == nil {
+		return ""
 	}
-	return ip
+	return realip.FromRequest(r)
 }
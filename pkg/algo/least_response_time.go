@@ -2,26 +2,36 @@ package algo
 
 import (
 	"net/http"
-	"sync"
 	bc "vgo-balancer/pkg/backend"
 )
 
-type LeastResponseTime struct {
-	mu sync.Mutex
+func init() {
+	Register("least-response-time", noOptions(func(pool []*bc.Backend) Algorithm { return &LeastResponseTime{} }))
 }
 
-func (lrt *LeastResponseTime) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
-	lrt.mu.Lock()
-	defer lrt.mu.Unlock()
+type LeastResponseTime struct{}
 
-	var selectedBackend *bc.Backend
+func (lrt *LeastResponseTime) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	// Warming up backends only compete for the share of requests they admit, a new backend
+	// without response time would take every request otherwise.
+	var selectedBackend, fallback *bc.Backend
+	var selectedLatency float64
 	for _, backend := range pool {
 		if backend.IsAlive.Load() {
-			if selectedBackend == nil || backend.ResponseTime < selectedBackend.ResponseTime {
+			if !admit(backend) {
+				fallback = backend
+				continue
+			}
+			latency := backend.Latency.Value()
+			if selectedBackend == nil || latency < selectedLatency {
 				selectedBackend = backend
+				selectedLatency = latency
 			}
 		}
 	}
+	if selectedBackend == nil {
+		return fallback
+	}
 	return selectedBackend
 }
 
@@ -0,0 +1,134 @@
+package algo
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+)
+
+// DefaultUnobservedPenalty is the cost of a busy backend without latency samples yet.
+const DefaultUnobservedPenalty = time.Second
+
+func init() {
+	Register("p2c", func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		return NewP2C(false, opts)
+	})
+	Register("p2c-ewma", func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		return NewP2C(true, opts)
+	})
+}
+
+// P2COptions are the lb_options of the p2c algorithms.
+type P2COptions struct {
+	Penalty time.Duration `yaml:"penalty"` // The latency assumed for a busy backend without latency samples yet.
+}
+
+// P2C is the power of two choices: two random alive backends are sampled and the one with the
+// lowest load wins. With EWMA set, the load is the moving average latency scaled by the requests
+// in flight, otherwise it is the requests in flight alone. No lock is taken to pick a backend.
+type P2C struct {
+	EWMA    bool
+	penalty float64
+}
+
+func NewP2C(ewma bool, opts Options) (*P2C, error) {
+	var o P2COptions
+	if err := opts.Decode(&o); err != nil {
+		return nil, err
+	}
+	if o.Penalty <= 0 {
+		o.Penalty = DefaultUnobservedPenalty
+	}
+	return &P2C{EWMA: ewma, penalty: float64(o.Penalty)}, nil
+}
+
+func (p *P2C) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	a, b := pickTwo(pool)
+	if a == nil || b == nil {
+		return a
+	}
+	// A backend using all its connections and streams queues requests, whatever its cost.
+	if sa, sb := a.Saturated(), b.Saturated(); sa != sb {
+		if sa {
+			return b
+		}
+		return a
+	}
+	if p.cost(b) < p.cost(a) {
+		return b
+	}
+	return a
+}
+
+func (p *P2C) Name() string {
+	if p.EWMA {
+		return "p2c-ewma"
+	}
+	return "p2c"
+}
+
+func (p *P2C) cost(b *bc.Backend) float64 {
+	inflight := float64(b.Inflight.Load())
+	// Requests in flight count relative to the capacity, so HTTP/2 backends multiplexing
+	// many streams per connection take a larger share.
+	cost := inflight + 1
+	if b.Capacity > 0 {
+		cost /= float64(b.Capacity)
+	}
+	if p.EWMA {
+		latency := b.Latency.Value()
+		if latency == 0 && inflight > 0 {
+			cost = p.penalty + inflight
+		} else {
+			cost = latency * (inflight + 1)
+		}
+	}
+	// Warming up backends look busier in proportion to their warm-up factor.
+	return cost / b.WarmupFactor()
+}
+
+// pickTwo samples two distinct alive backends. b is nil when only one backend is alive.
+func pickTwo(pool []*bc.Backend) (a, b *bc.Backend) {
+	n := len(pool)
+	if n == 0 {
+		return nil, nil
+	}
+	if n == 1 {
+		if pool[0].IsAlive.Load() {
+			return pool[0], nil
+		}
+		return nil, nil
+	}
+
+	// Sample the whole pool first, which is almost always enough when most backends are alive.
+	for attempt := 0; attempt < 3; attempt++ {
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++
+		}
+		if pool[i].IsAlive.Load() && pool[j].IsAlive.Load() {
+			return pool[i], pool[j]
+		}
+	}
+
+	alive := make([]*bc.Backend, 0, n)
+	for _, backend := range pool {
+		if backend.IsAlive.Load() {
+			alive = append(alive, backend)
+		}
+	}
+	switch len(alive) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alive[0], nil
+	}
+	i := rand.IntN(len(alive))
+	j := rand.IntN(len(alive) - 1)
+	if j >= i {
+		j++
+	}
+	return alive[i], alive[j]
+}
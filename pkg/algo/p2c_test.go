@@ -0,0 +1,78 @@
+package algo
+
+import (
+	"testing"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+)
+
+func newP2C(t *testing.T, ewma bool) *P2C {
+	t.Helper()
+	p, err := NewP2C(ewma, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestP2CLeastInflight(t *testing.T) {
+	pool := newTestPool(1, 1)
+	pool[0].Inflight.Store(5)
+	p := newP2C(t, false)
+
+	// With two backends, both are always sampled.
+	for i := 0; i < 100; i++ {
+		if got := p.NextBackend(pool, nil, nil); got != pool[1] {
+			t.Fatalf("picked %s, want the idle backend", got.URL)
+		}
+	}
+}
+
+func TestP2CSaturated(t *testing.T) {
+	pool := newTestPool(1, 1)
+	pool[0].Capacity, pool[1].Capacity = 10, 100
+	pool[0].Inflight.Store(10)
+	pool[1].Inflight.Store(90)
+	p := newP2C(t, false)
+
+	if got := p.NextBackend(pool, nil, nil); got != pool[1] {
+		t.Errorf("picked %s, want the backend with capacity left", got.URL)
+	}
+}
+
+func TestP2CEWMA(t *testing.T) {
+	pool := newTestPool(1, 1)
+	for _, b := range pool {
+		b.Latency = bc.NewEWMA(time.Minute)
+	}
+	pool[0].Latency.Observe(500 * time.Millisecond)
+	pool[1].Latency.Observe(10 * time.Millisecond)
+	p := newP2C(t, true)
+
+	if got := p.NextBackend(pool, nil, nil); got != pool[1] {
+		t.Errorf("picked %s, want the fastest backend", got.URL)
+	}
+	// The fast backend loses once enough requests queue on it.
+	pool[1].Inflight.Store(100)
+	if got := p.NextBackend(pool, nil, nil); got != pool[0] {
+		t.Errorf("picked %s, want the idle backend", got.URL)
+	}
+}
+
+func TestP2CAliveBackends(t *testing.T) {
+	pool := newTestPool(1, 1, 1, 1)
+	for _, b := range pool[:3] {
+		b.IsAlive.Store(false)
+	}
+	p := newP2C(t, false)
+
+	for i := 0; i < 100; i++ {
+		if got := p.NextBackend(pool, nil, nil); got != pool[3] {
+			t.Fatalf("picked %v, want the only alive backend", got)
+		}
+	}
+	pool[3].IsAlive.Store(false)
+	if got := p.NextBackend(pool, nil, nil); got != nil {
+		t.Errorf("picked %s without alive backends", got.URL)
+	}
+}
@@ -0,0 +1,177 @@
+package algo
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	bc "vgo-balancer/pkg/backend"
+)
+
+func init() {
+	Register("random", func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		src, err := newRandomSource(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Random{src: src}, nil
+	})
+	Register("weighted-random", func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		src, err := newRandomSource(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &WeightedRandom{src: src}, nil
+	})
+}
+
+// RandomOptions are the lb_options of the random algorithms.
+type RandomOptions struct {
+	Seed *uint64 `yaml:"seed"` // Seed makes the selection deterministic, e.g. in tests.
+}
+
+// RandomSource draws from the lock-free global generator, or from a seeded generator when a
+// seed is configured.
+type RandomSource struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newRandomSource(opts Options) (*RandomSource, error) {
+	var o RandomOptions
+	if err := opts.Decode(&o); err != nil {
+		return nil, err
+	}
+	return NewRandomSource(o.Seed), nil
+}
+
+// NewRandomSource returns a source seeded with seed, or the global generator when seed is nil.
+func NewRandomSource(seed *uint64) *RandomSource {
+	if seed == nil {
+		return &RandomSource{}
+	}
+	return &RandomSource{rng: rand.New(rand.NewPCG(*seed, *seed))}
+}
+
+func (s *RandomSource) IntN(n int) int {
+	if s.rng == nil {
+		return rand.IntN(n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.IntN(n)
+}
+
+// Random picks an alive backend uniformly at random.
+type Random struct {
+	src *RandomSource
+}
+
+func NewRandom(seed *uint64) *Random {
+	return &Random{src: NewRandomSource(seed)}
+}
+
+func (rd *Random) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	n := len(pool)
+	if n == 0 {
+		return nil
+	}
+
+	// Sample the whole pool first, which is almost always enough when most backends are alive.
+	for attempt := 0; attempt < 3; attempt++ {
+		if b := pool[rd.src.IntN(n)]; b.IsAlive.Load() && admit(b) {
+			return b
+		}
+	}
+
+	alive := make([]*bc.Backend, 0, n)
+	for _, b := range pool {
+		if b.IsAlive.Load() {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[rd.src.IntN(len(alive))]
+}
+
+func (rd *Random) Name() string {
+	return "random"
+}
+
+// WeightedRandom picks an alive backend at random with a probability proportional to its
+// effective weight. The cumulative weights are shared without a lock, and rebuilt once by a single
+// request when the generation of the backends changes: membership, status, weights or warm-up steps.
+type WeightedRandom struct {
+	src   *RandomSource
+	mu    sync.Mutex // mu serializes the rebuilds of the table.
+	table atomic.Pointer[weightTable]
+}
+
+type weightTable struct {
+	pool       []*bc.Backend
+	generation uint64 // generation is the generation of the backends the table was built for.
+	cumulative []int  // cumulative weights of the alive backends.
+	backends   []*bc.Backend
+	warming    []*bc.Backend // warming are the backends warming up, whose weight steps are watched.
+}
+
+func NewWeightedRandom(seed *uint64) *WeightedRandom {
+	return &WeightedRandom{src: NewRandomSource(seed)}
+}
+
+func (wr *WeightedRandom) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	t := wr.table.Load()
+	if t != nil {
+		// Reading the weights of the warming backends reports their warm-up steps.
+		for _, b := range t.warming {
+			b.EffectiveWeight()
+		}
+	}
+	if t == nil || !samePool(t.pool, pool) || t.generation != bc.Generation() {
+		t = wr.rebuild(pool)
+	}
+	if len(t.backends) == 0 {
+		return nil
+	}
+	return t.pick(wr.src)
+}
+
+func (wr *WeightedRandom) Name() string {
+	return "weighted-random"
+}
+
+// rebuild returns the table of the current generation of the pool, building it unless another
+// request just did.
+func (wr *WeightedRandom) rebuild(pool []*bc.Backend) *weightTable {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	// The generation is read first, so that changes during the build trigger another one.
+	generation := bc.Generation()
+	if t := wr.table.Load(); t != nil && samePool(t.pool, pool) && t.generation == generation {
+		return t
+	}
+	t := &weightTable{pool: pool, generation: generation}
+	total := 0
+	for _, b := range pool {
+		if !b.IsAlive.Load() {
+			continue
+		}
+		total += max(b.EffectiveWeight(), 1) // unset weight
+		t.cumulative = append(t.cumulative, total)
+		t.backends = append(t.backends, b)
+		if b.WarmupFactor() < 1 {
+			t.warming = append(t.warming, b)
+		}
+	}
+	wr.table.Store(t)
+	return t
+}
+
+func (t *weightTable) pick(src *RandomSource) *bc.Backend {
+	pick := src.IntN(t.cumulative[len(t.cumulative)-1])
+	return t.backends[sort.SearchInts(t.cumulative, pick+1)]
+}
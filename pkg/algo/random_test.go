@@ -0,0 +1,175 @@
+package algo
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+func newTestPool(weights ...int64) []*bc.Backend {
+	pool := make([]*bc.Backend, len(weights))
+	for i, w := range weights {
+		b := &bc.Backend{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("backend-%d", i)}}
+		b.Weight.Store(w)
+		b.IsAlive.Store(true)
+		pool[i] = b
+	}
+	return pool
+}
+
+// picks returns the indexes in the pool of n picks of the algorithm.
+func picks(a Algorithm, pool []*bc.Backend, n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = slices.Index(pool, a.NextBackend(pool, nil, nil))
+	}
+	return indexes
+}
+
+func count(indexes []int, n int) []int {
+	counts := make([]int, n)
+	for _, i := range indexes {
+		if i >= 0 {
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	seed := uint64(42)
+	pool := newTestPool(1, 2, 7, 0)
+	const n = 100000
+
+	got := picks(NewWeightedRandom(&seed), pool, n)
+	if again := picks(NewWeightedRandom(&seed), pool, n); !slices.Equal(got, again) {
+		t.Fatal("picks with the same seed differ")
+	}
+
+	// Unset weights count as 1.
+	want := []float64{0.1, 0.2, 0.7, 0.1}
+	total := 11.0 / 10
+	for i, c := range count(got, len(pool)) {
+		share := float64(c) / n
+		if expected := want[i] / total; math.Abs(share-expected) > 0.01 {
+			t.Errorf("backend %d got %.3f of the picks, want %.3f", i, share, expected)
+		}
+	}
+}
+
+func TestWeightedRandomSkipsDeadBackends(t *testing.T) {
+	seed := uint64(7)
+	pool := newTestPool(1, 1, 8)
+	wr := NewWeightedRandom(&seed)
+	picks(wr, pool, 10)
+
+	// The table built before the backend went down must not be picked from.
+	pool[2].SetAlive(false)
+	counts := count(picks(wr, pool, 1000), len(pool))
+	if counts[2] != 0 {
+		t.Errorf("dead backend picked %d times", counts[2])
+	}
+	if counts[0] == 0 || counts[1] == 0 {
+		t.Errorf("alive backends not picked: %v", counts)
+	}
+
+	pool[0].SetAlive(false)
+	pool[1].SetAlive(false)
+	if b := wr.NextBackend(pool, nil, nil); b != nil {
+		t.Errorf("picked %s with every backend down", b.URL)
+	}
+
+	// A recovered backend takes traffic on the next pick.
+	pool[2].SetAlive(true)
+	if b := wr.NextBackend(pool, nil, nil); b != pool[2] {
+		t.Errorf("picked %v, want the recovered backend", b)
+	}
+}
+
+func TestWeightedRandomRebuilds(t *testing.T) {
+	seed := uint64(3)
+	pool := newTestPool(1, 1)
+	wr := NewWeightedRandom(&seed)
+	picks(wr, pool, 10)
+
+	// The table is kept as long as the backends don't change.
+	table := wr.table.Load()
+	picks(wr, pool, 100)
+	if wr.table.Load() != table {
+		t.Error("table rebuilt without changes")
+	}
+
+	// Staying alive isn't a change.
+	pool[0].SetAlive(true)
+	picks(wr, pool, 1)
+	if wr.table.Load() != table {
+		t.Error("table rebuilt without a status change")
+	}
+
+	pool[1].SetAlive(false)
+	picks(wr, pool, 1)
+	if wr.table.Load() == table {
+		t.Error("table not rebuilt after a status change")
+	}
+}
+
+// newWarmingBackend returns a backend starting an hour long warm-up.
+func newWarmingBackend(t *testing.T, weight int) *bc.Backend {
+	t.Helper()
+	pool, err := bc.NewBEPool(&config.Service{
+		Name:      "warming",
+		Backends:  []config.Backend{{URL: "http://warming", Weight: weight}},
+		SlowStart: &config.SlowStart{Duration: time.Hour},
+	}, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	b.SetAlive(false)
+	b.SetAlive(true)
+	return b
+}
+
+func TestWeightedRandomWarmup(t *testing.T) {
+	seed := uint64(11)
+	pool := newTestPool(1, 1)
+	for _, b := range pool {
+		b.Weight.Store(100)
+	}
+	pool[1] = newWarmingBackend(t, 100)
+	const n = 20000
+
+	// The warming backend gets the share of its warm-up factor, 10% of its weight.
+	counts := count(picks(NewWeightedRandom(&seed), pool, n), len(pool))
+	if share := float64(counts[1]) / n; math.Abs(share-10.0/110) > 0.01 {
+		t.Errorf("warming backend got %.3f of the picks, want %.3f", share, 10.0/110)
+	}
+}
+
+func TestRandomDistribution(t *testing.T) {
+	seed := uint64(42)
+	pool := newTestPool(1, 1, 1, 1)
+	pool[3].IsAlive.Store(false)
+	const n = 30000
+
+	got := picks(NewRandom(&seed), pool, n)
+	if again := picks(NewRandom(&seed), pool, n); !slices.Equal(got, again) {
+		t.Fatal("picks with the same seed differ")
+	}
+	counts := count(got, len(pool))
+	if counts[3] != 0 {
+		t.Errorf("dead backend picked %d times", counts[3])
+	}
+	for i := 0; i < 3; i++ {
+		if share := float64(counts[i]) / n; math.Abs(share-1.0/3) > 0.01 {
+			t.Errorf("backend %d got %.3f of the picks, want 0.333", i, share)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package algo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	bc "vgo-balancer/pkg/backend"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultAlgorithm is used when a service doesn't set lb_type.
+const DefaultAlgorithm = "round-robin"
+
+// Options are the lb_options of a service, decoded by each algorithm into its typed options.
+type Options map[string]interface{}
+
+// Decode decodes the options into out, a pointer to the options struct of an algorithm.
+// Unknown options are reported as errors.
+func (o Options) Decode(out interface{}) error {
+	if len(o) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(map[string]interface{}(o))
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, out)
+}
+
+// Factory creates an algorithm for a pool of backends.
+type Factory func(pool []*bc.Backend, opts Options) (Algorithm, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes an algorithm available by name. It panics if the name is already registered,
+// and is meant to be called from the init function of the package implementing the algorithm.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("algo: Register factory is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic("algo: Register called twice for algorithm " + name)
+	}
+	registry[name] = factory
+}
+
+// Names returns the sorted names of the registered algorithms.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func CreateAlgorithm(name string, pool []*bc.Backend, opts Options) (Algorithm, error) {
+	if name == "" {
+		name = DefaultAlgorithm
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown load balancing algorithm %q, available algorithms: %v", name, Names())
+	}
+
+	algorithm, err := factory(pool, opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lb_options for %s: %w", name, err)
+	}
+	return algorithm, nil
+}
+
+// noOptions is the factory helper for algorithms without options.
+func noOptions(create func(pool []*bc.Backend) Algorithm) Factory {
+	return func(pool []*bc.Backend, opts Options) (Algorithm, error) {
+		if len(opts) > 0 {
+			return nil, fmt.Errorf("algorithm takes no options")
+		}
+		return create(pool), nil
+	}
+}
@@ -0,0 +1,112 @@
+package algo
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+)
+
+func TestCreateAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		lbType  string
+		opts    Options
+		want    string
+		wantErr string
+	}{
+		{"default", "", nil, DefaultAlgorithm, ""},
+		{"registered", "least-response-time", nil, "least-response-time", ""},
+		{"unknown", "round-robbin", nil, "", `unknown load balancing algorithm "round-robbin"`},
+		{"options of an algorithm without options", "round-robin", Options{"seed": 1}, "", "algorithm takes no options"},
+		{"unknown option", "p2c", Options{"penalti": "1s"}, "", "invalid lb_options for p2c"},
+		{"invalid option", "p2c", Options{"penalty": []string{"1s"}}, "", "invalid lb_options for p2c"},
+		{"options", "hash", Options{"key": []string{"header:X-Tenant-Id"}, "fallback": []string{"random"}}, "hash", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := CreateAlgorithm(tt.lbType, nil, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Name() != tt.want {
+				t.Errorf("algorithm = %s, want %s", a.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateAlgorithmUnknownListsNames(t *testing.T) {
+	_, err := CreateAlgorithm("nope", nil, nil)
+	if err == nil {
+		t.Fatal("unknown algorithm created")
+	}
+	for _, name := range Names() {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't list %s", err, name)
+		}
+	}
+}
+
+func TestOptionsDecode(t *testing.T) {
+	var o P2COptions
+	if err := (Options{"penalty": "250ms"}).Decode(&o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Penalty != 250*time.Millisecond {
+		t.Errorf("penalty = %v, want 250ms", o.Penalty)
+	}
+
+	var r RandomOptions
+	if err := (Options{"seed": 42}).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Seed == nil || *r.Seed != 42 {
+		t.Errorf("seed = %v, want 42", r.Seed)
+	}
+
+	// Empty options leave the defaults.
+	o = P2COptions{Penalty: time.Second}
+	if err := Options(nil).Decode(&o); err != nil || o.Penalty != time.Second {
+		t.Errorf("decoding no options = %v, %v", o, err)
+	}
+}
+
+type testAlgorithm struct{}
+
+func (testAlgorithm) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	return nil
+}
+
+func (testAlgorithm) Name() string { return "test-custom" }
+
+func TestRegister(t *testing.T) {
+	Register("test-custom", noOptions(func(pool []*bc.Backend) Algorithm { return testAlgorithm{} }))
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(registry, "test-custom")
+		registryMu.Unlock()
+	})
+
+	if !slices.Contains(Names(), "test-custom") {
+		t.Errorf("names = %v, want test-custom", Names())
+	}
+	if a, err := CreateAlgorithm("test-custom", nil, nil); err != nil || a.Name() != "test-custom" {
+		t.Errorf("created %v, %v", a, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	Register("test-custom", noOptions(func(pool []*bc.Backend) Algorithm { return testAlgorithm{} }))
+}
@@ -6,6 +6,10 @@ import (
 	bc "vgo-balancer/pkg/backend"
 )
 
+func init() {
+	Register("round-robin", noOptions(func(pool []*bc.Backend) Algorithm { return &RoundRobin{} }))
+}
+
 type RoundRobin struct {
 	mu    sync.Mutex
 	index int
@@ -19,16 +23,25 @@ func (r *RoundRobin) NextBackend(pool []*bc.Backend, w http.ResponseWriter, req
 		return nil
 	}
 
-	r.index = (r.index + 1) % len(pool)
+	start := (r.index + 1) % len(pool)
 
+	// A warming up backend that didn't take the request is still used if no other backend is alive.
+	var fallback *bc.Backend
 	for i := 0; i < len(pool); i++ {
-		r.index = (r.index + i) % len(pool)
-		if pool[r.index].IsAlive.Load() {
-			return pool[r.index]
+		r.index = (start + i) % len(pool)
+		b := pool[r.index]
+		if !b.IsAlive.Load() {
+			continue
+		}
+		if admit(b) {
+			return b
+		}
+		if fallback == nil {
+			fallback = b
 		}
 	}
 
-	return nil
+	return fallback
 }
 
 func (r *RoundRobin) Name() string {
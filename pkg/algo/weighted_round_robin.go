@@ -6,25 +6,25 @@ import (
 	bc "vgo-balancer/pkg/backend"
 )
 
+func init() {
+	Register("weighted-round-robin", noOptions(func(pool []*bc.Backend) Algorithm { return NewWeightedRoundRobin(pool) }))
+}
+
+// WeightedRoundRobin is the nginx smooth weighted round robin. Every pick adds the effective weight
+// of each alive backend to its current weight, selects the backend with the highest current weight
+// and subtracts the total weight from it. Picks are spread evenly instead of bursting to the
+// heaviest backend, and weight or membership changes apply on the next pick.
 type WeightedRoundRobin struct {
-	mx            sync.Mutex
-	currentIndex  int
-	maxWeight     int
-	gcdWeight     int
-	backendCount  int
-	currentWeight int
+	mx             sync.Mutex
+	currentWeights map[*bc.Backend]int
+	pool           []*bc.Backend // pool is the pool the current weights were computed for.
 }
 
 func NewWeightedRoundRobin(pool []*bc.Backend) *WeightedRoundRobin {
-	maxWeight := getMaxWeight(pool)
-	gcdWeight := getGCDWeight(pool)
-
 	return &WeightedRoundRobin{
-		mx:           sync.Mutex{},
-		currentIndex: -1,
-		maxWeight:    maxWeight,
-		gcdWeight:    gcdWeight,
-		backendCount: len(pool),
+		mx:             sync.Mutex{},
+		currentWeights: make(map[*bc.Backend]int, len(pool)),
+		pool:           pool,
 	}
 }
 
@@ -36,53 +36,51 @@ func (wrr *WeightedRoundRobin) NextBackend(pool []*bc.Backend, w http.ResponseWr
 		return nil
 	}
 
-	for i := 0; i < wrr.backendCount; i++ {
-		wrr.currentIndex = (wrr.currentIndex + 1) % wrr.backendCount
-
-		if wrr.currentIndex == 0 {
-			wrr.currentWeight -= wrr.gcdWeight
-			if wrr.currentWeight <= 0 {
-				wrr.currentWeight = wrr.maxWeight
-			}
+	// Forget the backends removed from the pool when the membership changed.
+	if !samePool(wrr.pool, pool) {
+		members := make(map[*bc.Backend]bool, len(pool))
+		for _, b := range pool {
+			members[b] = true
 		}
-
-		if pool[wrr.currentIndex].Weight >= wrr.currentWeight && pool[wrr.currentIndex].IsAlive.Load() {
-			return pool[wrr.currentIndex]
+		for b := range wrr.currentWeights {
+			if !members[b] {
+				delete(wrr.currentWeights, b)
+			}
 		}
+		wrr.pool = pool
 	}
 
-	return nil
-}
-
-func (w *WeightedRoundRobin) Name() string {
-	return "weighted-round-robin"
-}
+	total := 0
+	var selected *bc.Backend
+	for _, b := range pool {
+		if !b.IsAlive.Load() {
+			// A dead backend restarts from scratch once it recovers.
+			delete(wrr.currentWeights, b)
+			continue
+		}
 
-func getMaxWeight(pool []*bc.Backend) int {
-	max := 0
-	for _, p := range pool {
-		if p.Weight > max {
-			max = p.Weight
+		weight := b.EffectiveWeight()
+		if weight <= 0 {
+			weight = 1 // unset weight
+		}
+		wrr.currentWeights[b] += weight
+		total += weight
+		if selected == nil || wrr.currentWeights[b] > wrr.currentWeights[selected] {
+			selected = b
 		}
 	}
-	return max
-}
 
-func getGCDWeight(pool []*bc.Backend) int {
-	if len(pool) == 0 {
-		return 1
+	if selected != nil {
+		wrr.currentWeights[selected] -= total
 	}
+	return selected
+}
 
-	gcd := pool[0].Weight
-	for _, p := range pool[1:] {
-		gcd = getGCD(gcd, p.Weight)
-	}
-	return gcd
+func (w *WeightedRoundRobin) Name() string {
+	return "weighted-round-robin"
 }
 
-func getGCD(a, b int) int {
-	for b != 0 {
-		a, b = b, b%a
-	}
-	return a
+// samePool reports whether a and b are the same pool slice.
+func samePool(a, b []*bc.Backend) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
@@ -2,30 +2,76 @@ package backend
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/errorpage"
+	"vgo-balancer/pkg/proxyproto"
+	"vgo-balancer/pkg/realip"
 
 	"go.uber.org/zap"
 )
 
+// Supported backend protocols
+const (
+	ProtocolHTTP1 = "h1"
+	ProtocolHTTP2 = "h2"
+	ProtocolH2C   = "h2c"
+)
+
+// DefaultMaxStreams is the concurrent streams assumed per HTTP/2 connection, the usual
+// SETTINGS_MAX_CONCURRENT_STREAMS of servers.
+const DefaultMaxStreams = 100
+
+// generation counts the changes of the backends that affect their selection: membership, status,
+// weights and warm-up steps. Algorithms keeping state derived from the pool rebuild it when the
+// generation changes.
+var generation atomic.Uint64
+
+// Generation returns the current generation of the backends.
+func Generation() uint64 {
+	return generation.Load()
+}
+
 type BEPool struct {
-	Backends []*Backend // list of backends
-	Headers  *Header    // Headers is a list of headers to be added to the request.
+	Backends   atomic.Pointer[[]*Backend] // list of backends, replaced as a whole when membership changes.
+	Headers    *Header                    // Headers is a list of headers to be added to the request.
+	ErrorPages *errorpage.Pages           // ErrorPages render the errors answered instead of the backends.
+
+	mu             sync.Mutex // serializes membership updates.
+	requestTimeout time.Duration
+	slowStart      *SlowStart
+	forwarding     *Forwarding
+	grpc           bool // grpc is set for gRPC services, whose errors are reported as gRPC statuses.
+	logger         *zap.Logger
 }
 
 type Backend struct {
 	URL            *url.URL               // URL is the URL of the backend
-	Weight         int                    // Weight is the weight of the backend
+	Weight         atomic.Int64           // Weight is the weight of the backend
 	IsAlive        atomic.Bool            // IsAlive is the status of the backend.
-	ResponseTime   time.Duration          // ResponseTime is the response time of the backend.
+	Latency        *EWMA                  // Latency is the moving average of the response time of the backend.
+	Inflight       atomic.Int64           // Inflight is the number of requests being served by the backend.
 	RequestTimeout time.Duration          // RequestTimeout is the timeout for the request. e.g. 60s
 	Proxy          *httputil.ReverseProxy // proxy is the reverse proxy for the backend.
+	ProxyProtocol  string                 // ProxyProtocol is the PROXY protocol version sent to the backend.
+	Protocol       string                 // Protocol is the HTTP protocol spoken to the backend. e.g. h1, h2, h2c
+	Capacity       int64                  // Capacity is the number of requests the backend serves at once, connections times streams.
 	Logger         *zap.Logger
+
+	slowStart       *SlowStart   // slowStart is the warm-up configuration, nil when disabled.
+	warmupStart     atomic.Int64 // warmupStart is the start of the warm-up in unix nanoseconds, 0 when warmed up.
+	effectiveWeight atomic.Int64 // effectiveWeight is the last effective weight, to tell the warm-up steps.
+
+	// dial opens the connections of the proxy, sending the PROXY protocol header if configured.
+	dial func(context.Context, string, string) (net.Conn, error)
 }
 
 type Header struct {
@@ -33,77 +79,311 @@ type Header struct {
 	ResponseHeaders       map[string]string // ResponseHeaders is a list of headers to be added to the response.
 	RemoveRequestHeaders  []string          // RemoveRequestHeaders is a list of headers to be removed from the request.
 	RemoveResponseHeaders []string          // RemoveResponseHeaders is a list of headers to be removed from the response.
+
+	service       string       // service is the name of the service, for templates.
+	requestRules  []headerRule // requestRules are the compiled request headers and rules.
+	responseRules []headerRule // responseRules are the compiled response headers and rules.
 }
 
-func NewHeaders(h config.Header) *Header {
+func NewHeaders(h config.Header, service string) (*Header, error) {
+	requestRules, err := newHeaderRules(h.RequestHeaders, h.RequestHeaderRules, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request headers: %w", err)
+	}
+	responseRules, err := newHeaderRules(h.ResponseHeaders, h.ResponseHeaderRules, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response headers: %w", err)
+	}
+
 	return &Header{
 		RequestHeaders:        h.RequestHeaders,
 		ResponseHeaders:       h.ResponseHeaders,
 		RemoveRequestHeaders:  h.RemoveRequestHeaders,
 		RemoveResponseHeaders: h.RemoveResponseHeaders,
-	}
+		service:               service,
+		requestRules:          requestRules,
+		responseRules:         responseRules,
+	}, nil
 }
 
-func NewBEPool(backends []config.Backend, requestTimeout time.Duration, headers config.Header, logger *zap.Logger) *BEPool {
-	fHeader := NewHeaders(headers)
+// NewBEPool creates the backends of the service. The backends of gRPC services speak HTTP/2 and
+// their failures are reported to the clients as gRPC statuses.
+func NewBEPool(svc *config.Service, grpc bool, logger *zap.Logger) (*BEPool, error) {
+	// Handle if requestTimeout is empty, set it to 60s
+	requestTimeout := svc.RequestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = 60 * time.Second
+	}
+
+	headers, err := NewHeaders(svc.Headers, svc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPages, err := errorpage.New(svc.ErrorPages, svc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &BEPool{
+		Headers:        headers,
+		ErrorPages:     errorPages,
+		requestTimeout: requestTimeout,
+		slowStart:      NewSlowStart(svc.SlowStart),
+		forwarding:     NewForwarding(svc.Forwarding),
+		grpc:           grpc,
+		logger:         logger,
+	}
+
 	var b []*Backend
-	for _, backend := range backends {
-		cb := &Backend{
-			Weight:  backend.Weight,
-			IsAlive: atomic.Bool{},
-			Logger:  logger,
+	for _, backend := range svc.Backends {
+		cb, err := pool.newBackend(backend)
+		if err != nil {
+			logger.Warn("failed to create backend", zap.String("URL", backend.URL), zap.Error(err))
+			continue
 		}
+		b = append(b, cb)
+	}
+	pool.Backends.Store(&b)
+
+	return pool, nil
+}
+
+// GetBackends returns the current list of backends. The returned slice must not be modified.
+func (p *BEPool) GetBackends() []*Backend {
+	if b := p.Backends.Load(); b != nil {
+		return *b
+	}
+	return nil
+}
+
+// Update replaces the pool membership with the given backends. Backends whose URL is already
+// in the pool are kept (and their weight updated), so their connections and health state survive.
+// It returns the backends that were added and removed.
+func (p *BEPool) Update(backends []config.Backend) (added, removed []*Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
+	current := make(map[string]*Backend)
+	for _, b := range p.GetBackends() {
+		current[b.URL.String()] = b
+	}
+
+	var next []*Backend
+	seen := make(map[string]bool)
+	for _, backend := range backends {
 		backendURL, err := url.Parse(backend.URL)
 		if err != nil {
-			logger.Warn("failed to parse the backend URL", zap.String("URL", backend.URL), zap.Error(err))
+			p.logger.Warn("failed to parse the backend URL", zap.String("URL", backend.URL), zap.Error(err))
 			continue
 		}
+		key := backendURL.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if cb, ok := current[key]; ok {
+			cb.Weight.Store(int64(backend.Weight))
+			next = append(next, cb)
+			continue
+		}
+
+		cb, err := p.newBackend(backend)
+		if err != nil {
+			p.logger.Warn("failed to create backend", zap.String("URL", backend.URL), zap.Error(err))
+			continue
+		}
+		// New backends take their full share of traffic only once warmed up.
+		cb.startWarmup()
+		next = append(next, cb)
+		added = append(added, cb)
+	}
+
+	for key, b := range current {
+		if !seen[key] {
+			removed = append(removed, b)
+		}
+	}
+
+	p.Backends.Store(&next)
+	generation.Add(1)
+	return added, removed
+}
+
+func (p *BEPool) newBackend(backend config.Backend) (*Backend, error) {
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		return nil, err
+	}
 
-		// Handle if requestTimeout is empty, set it to 60s
-		if requestTimeout == 0 {
-			requestTimeout = 60 * time.Second
+	connPool := backend.ConnectionPool
+	if connPool == nil {
+		connPool = &config.Pool{}
+	}
+
+	fHeader := p.Headers
+	forwarding := p.forwarding
+	cb := &Backend{
+		URL:            backendURL,
+		RequestTimeout: p.requestTimeout,
+		Latency:        NewEWMA(DefaultLatencyDecay),
+		ProxyProtocol:  backend.ProxyProtocol,
+		Logger:         p.logger,
+		slowStart:      p.slowStart,
+	}
+	cb.Weight.Store(int64(backend.Weight))
+	cb.IsAlive.Store(true)
+	cb.Proxy = httputil.NewSingleHostReverseProxy(backendURL)
+	transport := &http.Transport{
+		MaxIdleConns:    getOrDefault(connPool.MaxIdle, 10),
+		MaxConnsPerHost: getOrDefault(connPool.MaxConnection, 10),
+		IdleConnTimeout: time.Duration(getOrDefault(connPool.IdleTimeout, 90)) * time.Second,
+		DialContext: defaultTransportDialContext(&net.Dialer{
+			Timeout: p.requestTimeout,
+		}),
+	}
+	cb.Protocol = backend.Protocol
+	if cb.Protocol == "" {
+		cb.Protocol = ProtocolHTTP1
+		// gRPC requires HTTP/2, cleartext unless the backend uses TLS.
+		if p.grpc {
+			cb.Protocol = ProtocolH2C
+			if backendURL.Scheme == "https" {
+				cb.Protocol = ProtocolHTTP2
+			}
+		}
+	}
+	cb.Capacity = int64(transport.MaxConnsPerHost)
+	switch cb.Protocol {
+	case ProtocolHTTP1:
+	case ProtocolHTTP2, ProtocolH2C:
+		transport.Protocols = new(http.Protocols)
+		if cb.Protocol == ProtocolHTTP2 {
+			transport.ForceAttemptHTTP2 = true
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
 		}
+		// Every connection multiplexes up to the stream limit of the backend.
+		cb.Capacity *= int64(getOrDefault(backend.MaxStreams, DefaultMaxStreams))
+	default:
+		return nil, fmt.Errorf("unsupported backend protocol %q", cb.Protocol)
+	}
 
-		cb.URL = backendURL
-		cb.IsAlive.Store(true)
-		cb.Proxy = httputil.NewSingleHostReverseProxy(backendURL)
-		cb.Proxy.Transport = http.DefaultTransport
-		cb.Proxy.Transport = &http.Transport{
-			MaxIdleConns:    getOrDefault(backend.ConnectionPool.MaxIdle, 10),
-			MaxConnsPerHost: getOrDefault(backend.ConnectionPool.MaxConnection, 10),
-			IdleConnTimeout: time.Duration(getOrDefault(backend.ConnectionPool.IdleTimeout, 90)) * time.Second,
-			DialContext: defaultTransportDialContext(&net.Dialer{
-				Timeout: requestTimeout,
-			}),
+	if backend.ProxyProtocol != "" {
+		if backend.ProxyProtocol != proxyproto.Version1 && backend.ProxyProtocol != proxyproto.Version2 {
+			return nil, fmt.Errorf("unsupported PROXY protocol version %q", backend.ProxyProtocol)
+		}
+		// The header describes the client of a single request, so connections can't be reused.
+		transport.DialContext = proxyProtocolDialContext(transport.DialContext, backend.ProxyProtocol)
+		transport.DisableKeepAlives = true
+	}
+	cb.dial = transport.DialContext
+	cb.Proxy.Transport = transport
+	grpc := p.grpc
+	cb.Proxy.ModifyResponse = func(response *http.Response) error {
+		if grpc {
+			grpcStatusFromHTTP(response)
 		}
-		cb.Proxy.ModifyResponse = func(response *http.Response) error {
-			RemoveResponseHeaders(fHeader, response)
-			AddResponseHeaders(fHeader, response)
+		if deferred, ok := response.Request.Context().Value(deferredHeadersKey{}).(*deferredHeaders); ok {
+			deferred.backend.Store(cb)
 			return nil
 		}
+		RemoveResponseHeaders(fHeader, response)
+		AddResponseHeaders(fHeader, response, cb)
+		return nil
+	}
+	if grpc {
+		// Streamed messages are flushed as they come, and trailers carry the status of the call.
+		cb.Proxy.FlushInterval = -1
+		cb.Proxy.ErrorHandler = grpcErrorHandler(cb)
+	} else {
+		cb.Proxy.ErrorHandler = errorHandler(cb, p.ErrorPages)
+	}
+
+	// Modify requests
+	originalDirector := cb.Proxy.Director
+	cb.Proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		forwarding.Apply(req)
+		RemoveRequestHeaders(fHeader, req)
+		AddRequestHeaders(fHeader, req, cb)
+	}
+
+	return cb, nil
+}
 
-		// Modify requests
-		originalDirector := cb.Proxy.Director
-		cb.Proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			RemoveRequestHeaders(fHeader, req)
-			AddRequestHeaders(fHeader, req)
+// errorHandler answers the requests the backend failed to serve with the error pages of the
+// service, telling timeouts from connection failures. Requests canceled by their client aren't
+// answered, nobody being left to read the page.
+func errorHandler(b *Backend, pages *errorpage.Pages) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			return
 		}
+		kind := errorpage.UpstreamConnect
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			kind = errorpage.UpstreamTimeout
+		}
+		b.Logger.Warn("Request to the backend failed", zap.String("backend", b.URL.String()), zap.String("error_page", string(kind)), zap.Error(err))
+		pages.Write(w, r, kind)
+	}
+}
 
-		b = append(b, cb)
+// Saturated reports whether the backend serves as many requests as its capacity, further
+// requests waiting for a connection or a stream.
+func (b *Backend) Saturated() bool {
+	return b.Capacity > 0 && b.Inflight.Load() >= b.Capacity
+}
+
+// Close releases the idle connections held by the backend's transport.
+func (b *Backend) Close() {
+	if t, ok := b.Proxy.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
 	}
+}
 
-	return &BEPool{
-		Backends: b,
-		Headers:  fHeader,
+// DialContext opens a connection to the address like the proxy of the backend does, sending the
+// PROXY protocol header when the backend expects one. Without a client in the context, e.g. for
+// health checks, the header is a LOCAL one.
+func (b *Backend) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if b.dial == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
 	}
+	return b.dial(ctx, network, addr)
 }
 
 func defaultTransportDialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
 	return dialer.DialContext
 }
 
+// proxyProtocolDialContext sends a PROXY protocol header with the address of the client of the
+// request on every new connection.
+func proxyProtocolDialContext(dial func(context.Context, string, string) (net.Conn, error), version string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var src, dst net.Addr
+		if clientAddr, ok := realip.ClientAddr(ctx); ok {
+			src = clientAddr
+		}
+		if localAddr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+			dst = localAddr
+		}
+		if err := proxyproto.WriteHeader(conn, version, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
 func getOrDefault(value, defaultValue int) int {
 	if value == 0 {
 		return defaultValue
@@ -117,9 +397,10 @@ func RemoveRequestHeaders(h *Header, r *http.Request) {
 	}
 }
 
-func AddRequestHeaders(h *Header, r *http.Request) {
-	for key, value := range h.RequestHeaders {
-		r.Header.Set(key, value)
+func AddRequestHeaders(h *Header, r *http.Request, b *Backend) {
+	data := &templateData{req: r, backend: b, service: h.service}
+	for i := range h.requestRules {
+		h.requestRules[i].apply(r.Header, data, 0)
 	}
 }
 
@@ -129,8 +410,43 @@ func RemoveResponseHeaders(h *Header, w *http.Response) {
 	}
 }
 
-func AddResponseHeaders(h *Header, w *http.Response) {
-	for key, value := range h.ResponseHeaders {
-		w.Header.Set(key, value)
+func AddResponseHeaders(h *Header, w *http.Response, b *Backend) {
+	data := &templateData{req: w.Request, backend: b, service: h.service}
+	for i := range h.responseRules {
+		h.responseRules[i].apply(w.Header, data, w.StatusCode)
+	}
+}
+
+type deferredHeadersKey struct{}
+
+// deferredHeaders is the backend that answered a request whose response header rules are deferred.
+type deferredHeaders struct {
+	backend atomic.Pointer[Backend]
+}
+
+// DeferResponseHeaders returns the context of a request whose response header rules aren't applied
+// by the proxy but by ApplyResponseHeaders, e.g. when the response of the backend is stored or
+// shared with other clients before reaching the client of the request.
+func DeferResponseHeaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deferredHeadersKey{}, &deferredHeaders{})
+}
+
+// FromBackend reports whether a backend answered the request, whose context comes from
+// DeferResponseHeaders, rather than the balancer itself, e.g. with an error page.
+func FromBackend(r *http.Request) bool {
+	deferred, ok := r.Context().Value(deferredHeadersKey{}).(*deferredHeaders)
+	return ok && deferred.backend.Load() != nil
+}
+
+// ApplyResponseHeaders applies the response header rules to the response sent to the client of the
+// request, whose context comes from DeferResponseHeaders. {{backend_url}} is empty when no backend
+// answered the request, e.g. for responses served from the cache.
+func (h *Header) ApplyResponseHeaders(header http.Header, r *http.Request, status int) {
+	var b *Backend
+	if deferred, ok := r.Context().Value(deferredHeadersKey{}).(*deferredHeaders); ok {
+		b = deferred.backend.Load()
 	}
+	response := &http.Response{Header: header, Request: r, StatusCode: status}
+	RemoveResponseHeaders(h, response)
+	AddResponseHeaders(h, response, b)
 }
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const DefaultLatencyDecay = 10 * time.Second
+
+// EWMA tracks the latency of a backend as a peak-sensitive exponentially weighted moving average.
+// A latency above the average replaces it right away so a slowing backend is penalized at once,
+// lower latencies are averaged in, and the average decays towards zero while the backend isn't
+// observed so that a backend which was slow in the past gets probed again.
+type EWMA struct {
+	mu    sync.Mutex
+	decay float64 // decay is the time constant of the average in nanoseconds.
+	value float64 // value is the average latency in nanoseconds.
+	stamp int64   // stamp is the time of the last update in unix nanoseconds.
+}
+
+func NewEWMA(decay time.Duration) *EWMA {
+	if decay <= 0 {
+		decay = DefaultLatencyDecay
+	}
+	return &EWMA{decay: float64(decay)}
+}
+
+// Observe adds a latency sample to the average.
+func (e *EWMA) Observe(latency time.Duration) {
+	now := time.Now().UnixNano()
+	rtt := float64(latency)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if rtt > e.value {
+		e.value = rtt
+	} else {
+		w := e.weight(now)
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.stamp = now
+}
+
+// Value returns the average latency decayed to the current time.
+func (e *EWMA) Value() float64 {
+	now := time.Now().UnixNano()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.value * e.weight(now)
+}
+
+func (e *EWMA) weight(now int64) float64 {
+	elapsed := math.Max(float64(now-e.stamp), 0)
+	return math.Exp(-elapsed / e.decay)
+}
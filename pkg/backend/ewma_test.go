@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	e := NewEWMA(10 * time.Second)
+	if v := e.Value(); v != 0 {
+		t.Errorf("value without samples = %v, want 0", v)
+	}
+
+	// A peak replaces the average at once.
+	e.Observe(100 * time.Millisecond)
+	if v := e.Value(); math.Abs(v-float64(100*time.Millisecond)) > float64(time.Millisecond) {
+		t.Errorf("value after a peak = %v, want 100ms", time.Duration(v))
+	}
+
+	// Lower latencies are averaged in by the time elapsed since the last sample.
+	e.mu.Lock()
+	e.stamp -= int64(10 * time.Second)
+	e.mu.Unlock()
+	e.Observe(0)
+	want := float64(100*time.Millisecond) / math.E
+	if v := e.Value(); math.Abs(v-want) > float64(time.Millisecond) {
+		t.Errorf("value after a fast sample = %v, want %v", time.Duration(v), time.Duration(want))
+	}
+}
+
+func TestEWMADecay(t *testing.T) {
+	e := NewEWMA(10 * time.Second)
+	e.Observe(time.Second)
+
+	// The average decays towards zero while the backend isn't observed.
+	for _, elapsed := range []time.Duration{10 * time.Second, 20 * time.Second, time.Minute} {
+		e.mu.Lock()
+		e.stamp = time.Now().Add(-elapsed).UnixNano()
+		e.mu.Unlock()
+		want := float64(time.Second) * math.Exp(-elapsed.Seconds()/10)
+		if v := e.Value(); math.Abs(v-want)/want > 0.01 {
+			t.Errorf("value after %v = %v, want %v", elapsed, time.Duration(v), time.Duration(want))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/realip"
+)
+
+// Supported X-Forwarded-For modes
+const (
+	XForwardedForAppend  = "append"
+	XForwardedForReplace = "replace"
+	XForwardedForOff     = "off"
+)
+
+// Forwarding sets the headers telling the backends about the original client request. Headers
+// received from a trusted proxy are passed on, the ones sent by anyone else are overwritten.
+type Forwarding struct {
+	xForwardedFor   string
+	xForwardedProto bool
+	xForwardedHost  bool
+	xForwardedPort  bool
+	forwarded       bool
+	preserveHost    bool
+}
+
+func NewForwarding(f *config.Forwarding) *Forwarding {
+	if f == nil {
+		f = &config.Forwarding{}
+	}
+
+	fwd := &Forwarding{
+		xForwardedFor:   f.XForwardedFor,
+		xForwardedProto: f.XForwardedProto,
+		xForwardedHost:  f.XForwardedHost,
+		xForwardedPort:  f.XForwardedPort,
+		forwarded:       f.Forwarded,
+		preserveHost:    f.PreserveHost == nil || *f.PreserveHost,
+	}
+	if fwd.xForwardedFor != XForwardedForReplace && fwd.xForwardedFor != XForwardedForOff {
+		fwd.xForwardedFor = XForwardedForAppend
+	}
+	return fwd
+}
+
+// Apply sets the forwarding headers of a request being sent to a backend. It is called from the
+// Director, after the request URL was rewritten to the backend.
+func (f *Forwarding) Apply(req *http.Request) {
+	trusted := realip.TrustedPeer(req)
+	peer := realip.PeerIP(req.RemoteAddr)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	// The reverse proxy appends the peer address to X-Forwarded-For after the Director runs.
+	switch f.xForwardedFor {
+	case XForwardedForOff:
+		req.Header["X-Forwarded-For"] = nil
+	case XForwardedForReplace:
+		req.Header.Del("X-Forwarded-For")
+		if clientIP := realip.FromRequest(req); clientIP != peer {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+
+	if f.xForwardedProto {
+		setForwardedHeader(req, "X-Forwarded-Proto", proto, trusted)
+	}
+	if f.xForwardedHost {
+		setForwardedHeader(req, "X-Forwarded-Host", req.Host, trusted)
+	}
+	if f.xForwardedPort {
+		setForwardedHeader(req, "X-Forwarded-Port", localPort(req, proto), trusted)
+	}
+
+	if f.forwarded {
+		element := "for=" + forwardedNode(peer) + ";host=" + quoteForwarded(req.Host) + ";proto=" + proto
+		if prior := req.Header.Values("Forwarded"); trusted && len(prior) > 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	}
+
+	if !f.preserveHost {
+		req.Host = req.URL.Host
+	}
+}
+
+// setForwardedHeader keeps the value sent by a trusted proxy, and overwrites any other.
+func setForwardedHeader(req *http.Request, key, value string, trusted bool) {
+	if trusted && req.Header.Get(key) != "" {
+		return
+	}
+	req.Header.Set(key, value)
+}
+
+// localPort returns the port the client connected to.
+func localPort(req *http.Request, proto string) string {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		return port
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedNode formats an IP as an RFC 7239 node, IPv6 addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+	return value
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/realip"
+)
+
+// forwardedRequest returns a request from the peer, resolved with 10.0.0.0/8 as trusted proxies
+// and rewritten to a backend like the Director does.
+func forwardedRequest(t *testing.T, peer string, headers map[string]string) *http.Request {
+	t.Helper()
+	resolver, err := realip.NewResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	r.RemoteAddr = peer
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	r = resolver.WithClientIP(r)
+	r.URL.Host = "backend:8080"
+	return r
+}
+
+func TestForwardingUntrustedPeer(t *testing.T) {
+	f := NewForwarding(&config.Forwarding{XForwardedProto: true, XForwardedHost: true, XForwardedPort: true, Forwarded: true})
+	r := forwardedRequest(t, "203.0.113.1:1234", map[string]string{
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example",
+		"X-Forwarded-Port":  "8443",
+		"Forwarded":         "for=1.2.3.4",
+	})
+	f.Apply(r)
+
+	// Headers sent by anyone else than a trusted proxy are overwritten.
+	want := map[string]string{
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Port":  "80",
+		"Forwarded":         "for=203.0.113.1;host=example.com;proto=http",
+	}
+	for k, v := range want {
+		if got := r.Header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if r.Host != "example.com" {
+		t.Errorf("Host = %q, want the client host", r.Host)
+	}
+}
+
+func TestForwardingTrustedPeer(t *testing.T) {
+	f := NewForwarding(&config.Forwarding{XForwardedFor: XForwardedForReplace, XForwardedProto: true, Forwarded: true})
+	r := forwardedRequest(t, "10.0.0.1:1234", map[string]string{
+		"X-Forwarded-For":   "1.2.3.4, 198.51.100.1",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=198.51.100.1",
+	})
+	f.Apply(r)
+
+	// The headers of a trusted proxy are passed on, the client IP being the resolved one.
+	want := map[string]string{
+		"X-Forwarded-For":   "198.51.100.1",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=198.51.100.1, for=10.0.0.1;host=example.com;proto=http",
+	}
+	for k, v := range want {
+		if got := r.Header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestForwardingXForwardedFor(t *testing.T) {
+	tests := []struct {
+		mode string
+		peer string
+		want []string
+	}{
+		// The reverse proxy appends the peer after the Director, nil stops it.
+		{XForwardedForAppend, "10.0.0.1:1234", []string{"198.51.100.1"}},
+		{XForwardedForReplace, "203.0.113.1:1234", []string{}},
+		{XForwardedForOff, "10.0.0.1:1234", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			f := NewForwarding(&config.Forwarding{XForwardedFor: tt.mode})
+			r := forwardedRequest(t, tt.peer, map[string]string{"X-Forwarded-For": "198.51.100.1"})
+			f.Apply(r)
+
+			got, ok := r.Header["X-Forwarded-For"]
+			if tt.want == nil {
+				if !ok || got != nil {
+					t.Errorf("X-Forwarded-For = %q, %v, want a nil value", got, ok)
+				}
+				return
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("X-Forwarded-For = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardingIPv6AndHost(t *testing.T) {
+	preserve := false
+	f := NewForwarding(&config.Forwarding{Forwarded: true, PreserveHost: &preserve})
+	r := forwardedRequest(t, "[2001:db8::1]:1234", nil)
+	r.Host = "example.com:8080"
+	f.Apply(r)
+
+	if got, want := r.Header.Get("Forwarded"), `for="[2001:db8::1]";host="example.com:8080";proto=http`; got != want {
+		t.Errorf("Forwarded = %q, want %q", got, want)
+	}
+	if r.Host != "backend:8080" {
+		t.Errorf("Host = %q, want the backend host", r.Host)
+	}
+}
@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// gRPC status codes used by the proxy, see https://grpc.io/docs/guides/status-codes/
+const (
+	GRPCStatusOK               = 0
+	GRPCStatusCanceled         = 1
+	GRPCStatusUnknown          = 2
+	GRPCStatusDeadlineExceeded = 4
+	GRPCStatusPermissionDenied = 7
+	GRPCStatusUnimplemented    = 12
+	GRPCStatusInternal         = 13
+	GRPCStatusUnavailable      = 14
+	GRPCStatusUnauthenticated  = 16
+	grpcContentType            = "application/grpc"
+	grpcTimeoutHeader          = "Grpc-Timeout"
+	grpcStatusHeader           = "Grpc-Status"
+	grpcMessageHeader          = "Grpc-Message"
+)
+
+// IsGRPCRequest reports whether the request is a gRPC call, e.g. application/grpc+proto.
+func IsGRPCRequest(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == grpcContentType || strings.HasPrefix(ct, grpcContentType+"+") || strings.HasPrefix(ct, grpcContentType+";")
+}
+
+// WriteGRPCError answers a call with a Trailers-Only response carrying the status, which gRPC
+// clients report as the error of the call instead of a protocol error.
+func WriteGRPCError(w http.ResponseWriter, code int, message string) {
+	h := w.Header()
+	h.Set("Content-Type", grpcContentType)
+	h.Set(grpcStatusHeader, strconv.Itoa(code))
+	if message != "" {
+		h.Set(grpcMessageHeader, encodeGRPCMessage(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GRPCTimeout parses the grpc-timeout header of a call, e.g. 100m for 100 milliseconds.
+func GRPCTimeout(r *http.Request) (time.Duration, bool) {
+	v := r.Header.Get(grpcTimeoutHeader)
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcErrorHandler maps the transport errors of the proxy to gRPC statuses instead of HTML 502s.
+func grpcErrorHandler(b *Backend) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		code := GRPCStatusUnavailable
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			code = GRPCStatusDeadlineExceeded
+		case errors.Is(err, context.Canceled):
+			code = GRPCStatusCanceled
+		}
+		b.Logger.Warn("gRPC call to the backend failed", zap.String("backend", b.URL.String()), zap.Int("grpc_status", code), zap.Error(err))
+		WriteGRPCError(w, code, "upstream "+b.URL.Host+": "+err.Error())
+	}
+}
+
+// grpcStatusFromHTTP turns the HTTP errors of backends or intermediaries without a gRPC status
+// into the status gRPC clients would derive from them, as specified in
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcStatusFromHTTP(resp *http.Response) {
+	if resp.StatusCode == http.StatusOK || resp.Header.Get(grpcStatusHeader) != "" {
+		return
+	}
+	code := GRPCStatusUnknown
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		code = GRPCStatusInternal
+	case http.StatusUnauthorized:
+		code = GRPCStatusUnauthenticated
+	case http.StatusForbidden:
+		code = GRPCStatusPermissionDenied
+	case http.StatusNotFound:
+		code = GRPCStatusUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = GRPCStatusUnavailable
+	}
+
+	message := "upstream returned HTTP status " + strconv.Itoa(resp.StatusCode)
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = http.Header{
+		"Content-Type":    {grpcContentType},
+		grpcStatusHeader:  {strconv.Itoa(code)},
+		grpcMessageHeader: {encodeGRPCMessage(message)},
+	}
+	resp.Trailer = nil
+}
+
+// encodeGRPCMessage percent-encodes a status message as required in the grpc-message header.
+func encodeGRPCMessage(message string) string {
+	var sb strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
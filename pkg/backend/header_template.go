@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/realip"
+	"vgo-balancer/pkg/requestid"
+)
+
+// Supported header rule actions
+const (
+	HeaderActionSet    = "set"
+	HeaderActionAppend = "append"
+)
+
+// Supported template variables
+const (
+	templateClientIP   = "client_ip"
+	templateRequestID  = "request_id"
+	templateBackendURL = "backend_url"
+	templateService    = "service"
+	templateTime       = "time"
+	templateHeader     = "header"
+	templateEnv        = "env"
+)
+
+// headerTemplate is a header value with {{variable}} placeholders, e.g. {{client_ip}} or
+// {{header "X-Foo"}}. Environment variables, {{env "NAME"}}, are expanded once when the template
+// is parsed.
+type headerTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	variable string // variable is empty for literal parts.
+	arg      string
+}
+
+// templateData is what a template is rendered with.
+type templateData struct {
+	req     *http.Request
+	backend *Backend
+	service string
+}
+
+// headerRule sets or appends a templated header when its condition matches.
+type headerRule struct {
+	name       string
+	value      *headerTemplate
+	append     bool
+	pathPrefix string
+	status     map[int]bool
+}
+
+func parseTemplate(value string) (*headerTemplate, error) {
+	t := &headerTemplate{}
+	for value != "" {
+		start := strings.Index(value, "{{")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{literal: value})
+			break
+		}
+		end := strings.Index(value[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", value)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: value[:start]})
+		}
+
+		part, err := parsePlaceholder(strings.TrimSpace(value[start+2 : start+end]))
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, part)
+		value = value[start+end+2:]
+	}
+	return t, nil
+}
+
+func parsePlaceholder(expr string) (templatePart, error) {
+	name, arg, hasArg := strings.Cut(expr, " ")
+	if hasArg {
+		unquoted, err := strconv.Unquote(strings.TrimSpace(arg))
+		if err != nil {
+			return templatePart{}, fmt.Errorf("invalid argument in {{%s}}: %w", expr, err)
+		}
+		arg = unquoted
+	}
+
+	switch name {
+	case templateClientIP, templateRequestID, templateBackendURL, templateService, templateTime:
+		if hasArg {
+			return templatePart{}, fmt.Errorf("{{%s}} takes no argument", name)
+		}
+	case templateHeader:
+		if arg == "" {
+			return templatePart{}, fmt.Errorf(`{{header}} requires a header name, e.g. {{header "X-Foo"}}`)
+		}
+	case templateEnv:
+		return templatePart{literal: os.Getenv(arg)}, nil
+	default:
+		return templatePart{}, fmt.Errorf("unknown placeholder {{%s}}", expr)
+	}
+	return templatePart{variable: name, arg: arg}, nil
+}
+
+func (t *headerTemplate) render(data *templateData) string {
+	if len(t.parts) == 1 && t.parts[0].variable == "" {
+		return t.parts[0].literal
+	}
+
+	var sb strings.Builder
+	for _, part := range t.parts {
+		switch part.variable {
+		case "":
+			sb.WriteString(part.literal)
+		case templateClientIP:
+			sb.WriteString(realip.FromRequest(data.req))
+		case templateRequestID:
+			sb.WriteString(requestid.FromRequest(data.req))
+		case templateBackendURL:
+			if data.backend != nil {
+				sb.WriteString(data.backend.URL.String())
+			}
+		case templateService:
+			sb.WriteString(data.service)
+		case templateTime:
+			sb.WriteString(time.Now().UTC().Format(time.RFC3339))
+		case templateHeader:
+			sb.WriteString(data.req.Header.Get(part.arg))
+		}
+	}
+	return sb.String()
+}
+
+// newHeaderRules compiles the headers and rules of requests, or of responses when response is set.
+// Only response rules can match status codes.
+func newHeaderRules(static map[string]string, rules []config.HeaderRule, response bool) ([]headerRule, error) {
+	var compiled []headerRule
+	for name, value := range static {
+		t, err := parseTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		compiled = append(compiled, headerRule{name: name, value: t})
+	}
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("header rule without a name")
+		}
+		t, err := parseTemplate(rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", rule.Name, err)
+		}
+
+		hr := headerRule{name: rule.Name, value: t}
+		switch rule.Action {
+		case "", HeaderActionSet:
+		case HeaderActionAppend:
+			hr.append = true
+		default:
+			return nil, fmt.Errorf("header %s: unsupported action %q", rule.Name, rule.Action)
+		}
+		if rule.When != nil {
+			hr.pathPrefix = rule.When.PathPrefix
+			if len(rule.When.StatusCodes) > 0 {
+				if !response {
+					return nil, fmt.Errorf("header %s: status_codes only apply to response headers", rule.Name)
+				}
+				hr.status = make(map[int]bool)
+				for _, code := range rule.When.StatusCodes {
+					hr.status[code] = true
+				}
+			}
+		}
+		compiled = append(compiled, hr)
+	}
+	return compiled, nil
+}
+
+// apply sets the header when the rule matches the request path and, for responses, the status.
+func (hr *headerRule) apply(h http.Header, data *templateData, status int) {
+	if hr.pathPrefix != "" && !strings.HasPrefix(data.req.URL.Path, hr.pathPrefix) {
+		return
+	}
+	if hr.status != nil && !hr.status[status] {
+		return
+	}
+
+	value := hr.value.render(data)
+	if hr.append {
+		h.Add(hr.name, value)
+	} else {
+		h.Set(hr.name, value)
+	}
+}
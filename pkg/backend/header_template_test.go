@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"vgo-balancer/pkg/config"
+)
+
+func TestNewHeadersStatusCodes(t *testing.T) {
+	when := &config.HeaderCondition{StatusCodes: []int{502}}
+	if _, err := NewHeaders(config.Header{ResponseHeaderRules: []config.HeaderRule{{Name: "X-Upstream", Value: "{{backend_url}}", When: when}}}, "web"); err != nil {
+		t.Errorf("response rule with status codes rejected: %v", err)
+	}
+
+	// Requests have no status, such a rule could never match.
+	_, err := NewHeaders(config.Header{RequestHeaderRules: []config.HeaderRule{{Name: "X-Retry", Value: "1", When: when}}}, "web")
+	if err == nil || !strings.Contains(err.Error(), "status_codes only apply to response headers") {
+		t.Errorf("error = %v, want status_codes rejected on a request rule", err)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{"static", ""},
+		{`{{client_ip}} via {{service}}`, ""},
+		{`{{header "X-Foo"}}`, ""},
+		{"{{client_ip", "unclosed placeholder"},
+		{"{{unknown}}", "unknown placeholder"},
+		{`{{time "now"}}`, "takes no argument"},
+		{"{{header}}", "requires a header name"},
+		{"{{header X-Foo}}", "invalid argument"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := parseTemplate(tt.value)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"math"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+const (
+	DefaultSlowStartMinWeightPercent = 10
+	DefaultSlowStartAggression       = 1.0
+)
+
+// SlowStart ramps up the effective weight of a backend after it recovers or joins the pool,
+// so that backends needing a warm-up don't receive their full share of traffic at once.
+type SlowStart struct {
+	Duration   time.Duration // Duration of the warm-up window.
+	MinFactor  float64       // MinFactor is the share of the weight a backend starts with.
+	Aggression float64       // Aggression shapes the curve, 1 is linear and higher values ramp up faster.
+}
+
+func NewSlowStart(s *config.SlowStart) *SlowStart {
+	if s == nil || s.Duration <= 0 {
+		return nil
+	}
+
+	slowStart := &SlowStart{
+		Duration:   s.Duration,
+		MinFactor:  float64(getOrDefault(s.MinWeightPercent, DefaultSlowStartMinWeightPercent)) / 100,
+		Aggression: s.Aggression,
+	}
+	if slowStart.Aggression <= 0 {
+		slowStart.Aggression = DefaultSlowStartAggression
+	}
+	slowStart.MinFactor = math.Min(math.Max(slowStart.MinFactor, 0.01), 1)
+	return slowStart
+}
+
+// factor returns the share of the weight a backend gets after warming up for elapsed.
+func (s *SlowStart) factor(elapsed time.Duration) float64 {
+	if elapsed >= s.Duration {
+		return 1
+	}
+	progress := math.Pow(float64(elapsed)/float64(s.Duration), 1/s.Aggression)
+	return math.Max(s.MinFactor, progress)
+}
+
+// SetAlive updates the status of the backend, starting its warm-up when it recovers.
+func (b *Backend) SetAlive(alive bool) {
+	if b.IsAlive.Swap(alive) == alive {
+		return
+	}
+	if alive {
+		b.startWarmup()
+	}
+	generation.Add(1)
+}
+
+func (b *Backend) startWarmup() {
+	if b.slowStart != nil {
+		b.warmupStart.Store(time.Now().UnixNano())
+	}
+}
+
+// WarmupFactor returns the share of its weight the backend currently gets, 1 once warmed up.
+func (b *Backend) WarmupFactor() float64 {
+	start := b.warmupStart.Load()
+	if start == 0 || b.slowStart == nil {
+		return 1
+	}
+
+	f := b.slowStart.factor(time.Since(time.Unix(0, start)))
+	if f >= 1 {
+		// Warm-up is over, skip the computation on the next calls.
+		b.warmupStart.CompareAndSwap(start, 0)
+	}
+	return f
+}
+
+// EffectiveWeight returns the weight of the backend scaled down while it is warming up. Every
+// change of the effective weight, like a step of the warm-up, starts a new generation.
+func (b *Backend) EffectiveWeight() int {
+	weight := int(b.Weight.Load())
+	if f := b.WarmupFactor(); f < 1 {
+		weight = max(1, int(math.Round(float64(weight)*f)))
+	}
+	if w := int64(weight); b.effectiveWeight.Load() != w && b.effectiveWeight.Swap(w) != w {
+		generation.Add(1)
+	}
+	return weight
+}
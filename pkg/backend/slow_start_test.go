@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"math"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+func TestNewSlowStart(t *testing.T) {
+	if s := NewSlowStart(nil); s != nil {
+		t.Errorf("slow start without configuration = %+v, want nil", s)
+	}
+	if s := NewSlowStart(&config.SlowStart{}); s != nil {
+		t.Errorf("slow start without duration = %+v, want nil", s)
+	}
+	s := NewSlowStart(&config.SlowStart{Duration: time.Minute})
+	if s.MinFactor != 0.1 || s.Aggression != 1 {
+		t.Errorf("defaults = %+v, want a 0.1 min factor and an aggression of 1", s)
+	}
+	if s := NewSlowStart(&config.SlowStart{Duration: time.Minute, MinWeightPercent: 500}); s.MinFactor != 1 {
+		t.Errorf("min factor = %v, want it capped at 1", s.MinFactor)
+	}
+}
+
+func TestSlowStartFactor(t *testing.T) {
+	tests := []struct {
+		name       string
+		aggression float64
+		elapsed    time.Duration
+		want       float64
+	}{
+		{"start", 1, 0, 0.1},
+		{"below the minimum", 1, 5 * time.Second, 0.1},
+		{"linear", 1, 30 * time.Second, 0.5},
+		{"aggressive", 2, 15 * time.Second, 0.5},
+		{"over", 1, time.Minute, 1},
+		{"long over", 2, time.Hour, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SlowStart{Duration: time.Minute, MinFactor: 0.1, Aggression: tt.aggression}
+			if got := s.factor(tt.elapsed); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("factor(%v) = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendWarmup(t *testing.T) {
+	b := &Backend{slowStart: &SlowStart{Duration: time.Hour, MinFactor: 0.1, Aggression: 1}}
+	b.Weight.Store(100)
+	b.IsAlive.Store(true)
+
+	// Staying alive doesn't start a warm-up.
+	b.SetAlive(true)
+	if w := b.EffectiveWeight(); w != 100 {
+		t.Errorf("effective weight = %d, want 100", w)
+	}
+
+	// Recovering does.
+	b.SetAlive(false)
+	b.SetAlive(true)
+	if w := b.EffectiveWeight(); w != 10 {
+		t.Errorf("effective weight after recovering = %d, want 10", w)
+	}
+
+	// Small weights keep at least 1.
+	b.Weight.Store(2)
+	if w := b.EffectiveWeight(); w != 1 {
+		t.Errorf("effective weight of a small backend = %d, want 1", w)
+	}
+
+	// The warm-up ends after its duration.
+	b.warmupStart.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if f := b.WarmupFactor(); f != 1 {
+		t.Errorf("warm-up factor after the duration = %v, want 1", f)
+	}
+	if start := b.warmupStart.Load(); start != 0 {
+		t.Errorf("warm-up start = %d after the warm-up, want 0", start)
+	}
+}
+
+func TestBackendWithoutSlowStart(t *testing.T) {
+	b := &Backend{}
+	b.Weight.Store(5)
+	b.SetAlive(false)
+	b.SetAlive(true)
+	if w := b.EffectiveWeight(); w != 5 {
+		t.Errorf("effective weight = %d, want 5", w)
+	}
+}
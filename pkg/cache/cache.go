@@ -0,0 +1,360 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+// Defaults of the cache
+const (
+	DefaultMaxBytes       = 64 << 20
+	DefaultMaxObjectBytes = 1 << 20
+)
+
+// Cache answers the cacheable GET requests of a service from the stored responses of the
+// backends, following the shared cache semantics of RFC 9111.
+type Cache struct {
+	store                Store
+	maxObjectBytes       int64
+	defaultTTL           time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+
+	mu           sync.Mutex
+	revalidating map[string]bool // revalidating are the keys refreshed in the background.
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	stale  atomic.Int64
+}
+
+// Stats are the counters of a cache.
+type Stats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Stale   int64 `json:"stale"`
+}
+
+// New creates the cache of a service, stored in memory or on disk when a directory is configured.
+func New(cfg *config.Cache) (*Cache, error) {
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	c := &Cache{
+		maxObjectBytes:       cfg.MaxObjectBytes,
+		defaultTTL:           cfg.DefaultTTL,
+		staleWhileRevalidate: cfg.StaleWhileRevalidate,
+		staleIfError:         cfg.StaleIfError,
+		revalidating:         make(map[string]bool),
+	}
+	if c.maxObjectBytes <= 0 {
+		c.maxObjectBytes = DefaultMaxObjectBytes
+	}
+	if cfg.Dir != "" {
+		store, err := NewDiskStore(cfg.Dir, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	} else {
+		c.store = NewMemoryStore(maxBytes)
+	}
+	return c, nil
+}
+
+// ServeHTTP answers the request from the cache, or with next, storing its response when cacheable.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// Protocol switches, e.g. websockets, take over the connection of the client.
+	if r.Header.Get("Upgrade") != "" {
+		next(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+		// Unsafe methods invalidate the stored responses of the target when they succeed, RFC 9111
+		// section 4.4.
+		if sw.status < 400 {
+			c.invalidate(primaryKey(r))
+		}
+		return
+	default:
+		next(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		next(w, r)
+		return
+	}
+
+	key := primaryKey(r)
+	entry := c.lookup(key, r)
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		c.misses.Add(1)
+		c.fetch(w, r, key, nil, next)
+		return
+	}
+
+	now := time.Now()
+	age, lifetime := entry.age(now), entry.lifetime(c.defaultTTL)
+	revalidate := reqCC.has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		revalidate = true
+	}
+	switch {
+	case !revalidate && age < lifetime:
+		c.hits.Add(1)
+		c.serve(w, r, entry, "HIT", now)
+	case reqCC.has("only-if-cached"):
+		c.stale.Add(1)
+		c.serve(w, r, entry, "STALE", now)
+	case !revalidate && age < lifetime+entry.staleWindow("stale-while-revalidate", c.staleWhileRevalidate):
+		c.stale.Add(1)
+		c.serve(w, r, entry, "STALE", now)
+		c.revalidateAsync(r, key, entry, next)
+	default:
+		c.misses.Add(1)
+		c.fetch(w, r, key, entry, next)
+	}
+}
+
+// fetch answers the request with next. The stale entry, if any, is revalidated and served when
+// the backends fail within its stale-if-error window.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, key string, stale *Entry, next http.HandlerFunc) {
+	rw := newResponseWriter(w, c.maxObjectBytes)
+	rw.cacheStatus = "MISS"
+	out := r
+	requestTime := time.Now()
+	if stale != nil {
+		age := stale.age(requestTime)
+		rw.staleOnError = age < stale.lifetime(c.defaultTTL)+stale.staleWindow("stale-if-error", c.staleIfError)
+		// The 304 to the conditional requests of the client are theirs.
+		if stale.hasValidators() && !conditional(r) {
+			out = withValidators(r, r.Context(), stale)
+			rw.revalidating = true
+		}
+	}
+
+	next(rw, out)
+	rw.finish()
+	responseTime := time.Now()
+
+	switch {
+	case rw.swallowed && rw.status == http.StatusNotModified:
+		updated := stale.refreshed(rw.header, requestTime, responseTime)
+		c.store.Set(updated.Key, updated)
+		c.serve(w, r, updated, "REVALIDATED", responseTime)
+	case rw.swallowed:
+		c.stale.Add(1)
+		c.serve(w, r, stale, "STALE", responseTime)
+	case !rw.overflow && rw.headerWritten && storable(r, rw.status, rw.header):
+		c.save(r, key, &Entry{
+			Status:       rw.status,
+			Header:       rw.header,
+			Body:         rw.body,
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+		})
+	}
+}
+
+// revalidateAsync refreshes the entry in the background, once at a time per key.
+func (c *Cache) revalidateAsync(r *http.Request, key string, stale *Entry, next http.HandlerFunc) {
+	c.mu.Lock()
+	if c.revalidating[stale.Key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[stale.Key] = true
+	c.mu.Unlock()
+
+	// The refresh outlives the request of the client.
+	out := withValidators(r, context.WithoutCancel(r.Context()), stale)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, stale.Key)
+			c.mu.Unlock()
+		}()
+
+		bw := &bufferWriter{header: make(http.Header), maxBytes: c.maxObjectBytes}
+		requestTime := time.Now()
+		next(bw, out)
+		responseTime := time.Now()
+
+		switch {
+		case bw.status == http.StatusNotModified:
+			updated := stale.refreshed(bw.header, requestTime, responseTime)
+			c.store.Set(updated.Key, updated)
+		case !bw.overflow && storable(out, bw.status, bw.header):
+			c.save(out, key, &Entry{
+				Status:       bw.status,
+				Header:       bw.header,
+				Body:         bw.body,
+				RequestTime:  requestTime,
+				ResponseTime: responseTime,
+			})
+		}
+	}()
+}
+
+// lookup returns the entry of the request, selecting the variant matching its headers.
+func (c *Cache) lookup(key string, r *http.Request) *Entry {
+	e, ok := c.store.Get(key)
+	if !ok {
+		return nil
+	}
+	if e.isVariants() {
+		if e, ok = c.store.Get(variantKey(key, e.Vary, r.Header)); !ok {
+			return nil
+		}
+	}
+	return e
+}
+
+// save stores the response, under the variant of the request when it varies on request headers.
+func (c *Cache) save(r *http.Request, key string, e *Entry) {
+	e.Key = key
+	vary := varyHeaders(e.Header)
+	if len(vary) > 0 {
+		c.store.Set(key, &Entry{Key: key, Vary: vary})
+		e.Key = variantKey(key, vary, r.Header)
+	}
+	c.store.Set(e.Key, e)
+}
+
+// invalidate removes the response stored under the key and its variants.
+func (c *Cache) invalidate(key string) {
+	e, ok := c.store.Get(key)
+	if !ok {
+		return
+	}
+	c.store.Delete(key)
+	if e.isVariants() {
+		for _, k := range c.store.Keys() {
+			if strings.HasPrefix(k, key+"\x00") {
+				c.store.Delete(k)
+			}
+		}
+	}
+}
+
+// Purge removes the stored responses whose path starts with the prefix, every response when the
+// prefix is empty, and returns the number of entries removed.
+func (c *Cache) Purge(prefix string) int {
+	n := 0
+	for _, key := range c.store.Keys() {
+		i := strings.IndexByte(key, '/')
+		if i < 0 || !strings.HasPrefix(key[i:], prefix) {
+			continue
+		}
+		c.store.Delete(key)
+		n++
+	}
+	return n
+}
+
+// Stats returns the size and counters of the cache.
+func (c *Cache) Stats() Stats {
+	entries, bytes := c.store.Stats()
+	return Stats{
+		Entries: entries,
+		Bytes:   bytes,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Stale:   c.stale.Load(),
+	}
+}
+
+// serve answers the request with the entry, or with a 304 when it satisfies the conditions of
+// the client.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *Entry, status string, now time.Time) {
+	h := w.Header()
+	copyHeader(h, e.Header)
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", status)
+
+	if notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// primaryKey identifies the target of the request.
+func primaryKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// variantKey identifies the variant of the response selected by the request headers.
+func variantKey(key string, vary []string, header http.Header) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range vary {
+		sb.WriteString("\x00" + name + ":" + strings.Join(header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+// withValidators returns the request made conditional on the validators of the entry.
+func withValidators(r *http.Request, ctx context.Context, e *Entry) *http.Request {
+	out := r.Clone(ctx)
+	out.Body = http.NoBody
+	if etag := e.Header.Get("ETag"); etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified evaluates the conditions of the request against the entry, RFC 9110 section 13.2.2.
+func notModified(r *http.Request, e *Entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		return slices.ContainsFunc(strings.Split(inm, ","), func(tag string) bool {
+			tag = strings.TrimSpace(tag)
+			return tag == "*" || strings.TrimPrefix(tag, "W/") == etag
+		})
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
@@ -0,0 +1,315 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+// testBackend is a backend behind a reverse proxy answering with its handler, and with a 502 once
+// closed.
+type testBackend struct {
+	srv      *httptest.Server
+	proxy    *httputil.ReverseProxy
+	requests atomic.Int64
+}
+
+func newTestBackend(t *testing.T, handler http.HandlerFunc) *testBackend {
+	t.Helper()
+	b := &testBackend{}
+	b.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(b.srv.Close)
+	target, _ := url.Parse(b.srv.URL)
+	b.proxy = httputil.NewSingleHostReverseProxy(target)
+	b.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return b
+}
+
+func newTestCache(t *testing.T, cfg *config.Cache) *Cache {
+	t.Helper()
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// get sends a GET request with the headers through the cache.
+func get(c *Cache, b *testBackend, pairs ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	r.Header = header(pairs...)
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r, b.proxy.ServeHTTP)
+	return w
+}
+
+func expect(t *testing.T, w *httptest.ResponseRecorder, status int, cacheStatus, body string) {
+	t.Helper()
+	if w.Code != status || w.Header().Get("X-Cache") != cacheStatus || w.Body.String() != body {
+		t.Errorf("got %d %q %q, want %d %q %q", w.Code, w.Header().Get("X-Cache"), w.Body.String(), status, cacheStatus, body)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Version", "v1")
+		fmt.Fprint(w, "hello")
+	})
+	c := newTestCache(t, &config.Cache{})
+
+	expect(t, get(c, b), 200, "MISS", "hello")
+	w := get(c, b)
+	expect(t, w, 200, "HIT", "hello")
+
+	// Responses don't share their header values with the stored entry.
+	w.Header()["X-Version"][0] = "changed"
+	if w := get(c, b); w.Header().Get("X-Version") != "v1" {
+		t.Errorf("X-Version = %q after a response was modified, want v1", w.Header().Get("X-Version"))
+	}
+	if n := b.requests.Load(); n != 1 {
+		t.Errorf("%d requests to the backend, want 1", n)
+	}
+	if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("stats = %+v, want 2 hits, 1 miss and 1 entry", stats)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		staleIfError time.Duration
+		wantStale    bool
+	}{
+		{"directive", "max-age=0, stale-if-error=60", 0, true},
+		{"configured", "max-age=0", time.Minute, true},
+		{"disabled", "max-age=0", 0, false},
+		{"must-revalidate", "max-age=0, must-revalidate, stale-if-error=60", time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				fmt.Fprint(w, "hello")
+			})
+			c := newTestCache(t, &config.Cache{StaleIfError: tt.staleIfError})
+			expect(t, get(c, b), 200, "MISS", "hello")
+
+			// Every backend is down.
+			b.srv.Close()
+			if tt.wantStale {
+				expect(t, get(c, b), 200, "STALE", "hello")
+			} else {
+				expect(t, get(c, b), http.StatusBadGateway, "MISS", "")
+			}
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var conditional atomic.Int64
+	b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	c := newTestCache(t, &config.Cache{})
+
+	expect(t, get(c, b), 200, "MISS", "hello")
+	// The expired entry is revalidated with its ETag, and served as a 200 to an unconditional request.
+	expect(t, get(c, b), 200, "REVALIDATED", "hello")
+	if n := conditional.Load(); n != 1 {
+		t.Errorf("%d conditional requests to the backend, want 1", n)
+	}
+	// The 304 to the conditional request of a client is passed on.
+	expect(t, get(c, b, "If-None-Match", `"v1"`), http.StatusNotModified, "MISS", "")
+}
+
+func TestCacheVary(t *testing.T) {
+	b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, "hello "+r.Header.Get("Accept-Language"))
+	})
+	c := newTestCache(t, &config.Cache{})
+
+	expect(t, get(c, b, "Accept-Language", "en"), 200, "MISS", "hello en")
+	expect(t, get(c, b, "Accept-Language", "fr"), 200, "MISS", "hello fr")
+	expect(t, get(c, b, "Accept-Language", "en"), 200, "HIT", "hello en")
+	expect(t, get(c, b, "Accept-Language", "fr"), 200, "HIT", "hello fr")
+
+	// Unsafe methods invalidate every variant.
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/page", nil)
+	c.ServeHTTP(httptest.NewRecorder(), r, b.proxy.ServeHTTP)
+	expect(t, get(c, b, "Accept-Language", "fr"), 200, "MISS", "hello fr")
+}
+
+func TestCacheUnsafeInvalidation(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		wantInvalidate bool
+	}{
+		{"success", http.StatusOK, true},
+		{"no content", http.StatusNoContent, true},
+		{"redirect", http.StatusSeeOther, true},
+		{"client error", http.StatusBadRequest, false},
+		{"server error", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprint(w, "hello")
+			})
+			c := newTestCache(t, &config.Cache{})
+			expect(t, get(c, b), 200, "MISS", "hello")
+
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/page", nil)
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r, b.proxy.ServeHTTP)
+			if w.Code != tt.status {
+				t.Fatalf("POST status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.wantInvalidate {
+				expect(t, get(c, b), 200, "MISS", "hello")
+			} else {
+				expect(t, get(c, b), 200, "HIT", "hello")
+			}
+		})
+	}
+}
+
+func TestCacheUpgrade(t *testing.T) {
+	c := newTestCache(t, &config.Cache{})
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r, func(rw http.ResponseWriter, r *http.Request) {
+		// The handler must be able to take over the connection of the client.
+		if rw != http.ResponseWriter(w) {
+			t.Errorf("upgrade served with %T, want the writer of the client", rw)
+		}
+	})
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(key, body string) *Entry {
+		return &Entry{Key: key, Status: 200, Header: header("ETag", `"`+body+`"`), Body: []byte(body)}
+	}
+	size := encodedSize(t, entry("a", "0123456789"))
+	s, err := NewDiskStore(dir, 2*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", entry("a", "0123456789"))
+	s.Set("b", entry("b", "abcdefghij"))
+	s.Get("a")
+	// The least recently used entry is evicted.
+	s.Set("c", entry("c", "ABCDEFGHIJ"))
+	if _, ok := s.Get("b"); ok {
+		t.Error("entry b not evicted")
+	}
+
+	// The entries survive a restart, leftovers of interrupted writes being removed.
+	if err := os.WriteFile(filepath.Join(dir, diskTempPrefix+"partial"), []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewDiskStore(dir, 2*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, bytes := s.Stats(); entries != 2 || bytes != 2*size {
+		t.Errorf("reloaded %d entries of %d bytes, want 2 of %d", entries, bytes, 2*size)
+	}
+	for key, body := range map[string]string{"a": "0123456789", "c": "ABCDEFGHIJ"} {
+		e, ok := s.Get(key)
+		if !ok || string(e.Body) != body || e.Header.Get("ETag") != `"`+body+`"` {
+			t.Errorf("entry %s = %+v after a restart", key, e)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d files in the store, want 2: %v", len(files), files)
+	}
+}
+
+func TestDiskStoreConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				key := fmt.Sprintf("k%d", j%4)
+				if (i+j)%3 == 0 {
+					s.Delete(key)
+				} else {
+					s.Set(key, &Entry{Key: key, Status: 200, Body: []byte(strings.Repeat("x", i*10+j))})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The index accounts for exactly the files in the store.
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if entries, bytes := s.Stats(); entries != len(files) || bytes != total {
+		t.Errorf("index of %d entries of %d bytes, want the %d files of %d bytes", entries, bytes, len(files), total)
+	}
+}
+
+// encodedSize returns the size of the entry once stored on disk.
+func encodedSize(t *testing.T, e *Entry) int64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		t.Fatal(err)
+	}
+	return int64(buf.Len())
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+// Defaults of request coalescing
+const (
+	DefaultCoalesceMaxWait  = 5 * time.Second
+	DefaultCoalesceMaxBytes = 1 << 20
+	defaultRequestTimeout   = 60 * time.Second
+
+	// maxLearnedVary bounds the URLs whose Vary is remembered.
+	maxLearnedVary = 10000
+)
+
+// Coalescer collapses identical concurrent GET requests into a single request to the backends,
+// whose response is shared with the requests waiting for it.
+type Coalescer struct {
+	maxWait     time.Duration
+	maxBytes    int64
+	detached    time.Duration              // detached bounds the requests read on once their client is gone.
+	fromBackend func(r *http.Request) bool // fromBackend tells the responses of the backends from those of the balancer.
+
+	mu    sync.Mutex
+	calls map[string]*call    // calls are the requests in flight by key.
+	vary  map[string][]string // vary are the request headers the responses vary on by URL.
+}
+
+// call is a request in flight, its response shared once done is closed.
+type call struct {
+	done   chan struct{}
+	header http.Header // header are the headers of the request, matched against the Vary of the response.
+	shared bool        // shared is set when the response can be given to the waiting requests.
+	status int
+	resp   http.Header
+	body   []byte
+}
+
+// NewCoalescer creates the coalescer of a service. Only the responses for which fromBackend
+// returns true are shared, so that the error pages of the balancer, e.g. for a leader request
+// failing on its own, aren't given to the waiting requests. requestTimeout is the request timeout
+// of the service, 60s when 0.
+func NewCoalescer(cfg *config.Coalesce, fromBackend func(r *http.Request) bool, requestTimeout time.Duration) *Coalescer {
+	c := &Coalescer{
+		maxWait:     cfg.MaxWait,
+		maxBytes:    cfg.MaxBytes,
+		fromBackend: fromBackend,
+		calls:       make(map[string]*call),
+		vary:        make(map[string][]string),
+	}
+	if c.maxWait <= 0 {
+		c.maxWait = DefaultCoalesceMaxWait
+	}
+	if c.maxBytes <= 0 {
+		c.maxBytes = DefaultCoalesceMaxBytes
+	}
+	if requestTimeout <= 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+	c.detached = c.maxWait + requestTimeout
+	return c
+}
+
+// ServeHTTP answers the request with next, or with the response of an identical request in flight.
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !coalescable(r) {
+		next(w, r)
+		return
+	}
+
+	c.mu.Lock()
+	// Requests are identical when they select the same variant of the last response to the URL.
+	// Conditional requests also need the same conditions, e.g. the revalidations of the cache.
+	url := primaryKey(r)
+	key := variantKey(url, c.vary[url], r.Header) + "\x00" + r.Header.Get("If-None-Match") + "\x00" + r.Header.Get("If-Modified-Since")
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		c.wait(w, r, cl, next)
+		return
+	}
+	cl := &call{done: make(chan struct{}), header: r.Header}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		if c.calls[key] == cl {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+	}
+	// The waiting requests go to the backends themselves when the request panics, e.g. aborted by
+	// the proxy.
+	defer func() {
+		forget()
+		close(cl.done)
+	}()
+
+	// The response is read for the waiting requests even when the client of the leader goes away,
+	// but not forever: a stalled backend would otherwise hold the call, and every identical
+	// request joining it, until the response comes.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), c.detached)
+	defer cancel()
+	stop := context.AfterFunc(ctx, forget)
+	defer stop()
+	rw := newResponseWriter(w, c.maxBytes)
+	rw.detached = true
+	out := r.WithContext(ctx)
+	next(rw, out)
+	rw.finish()
+	if !rw.headerWritten || !shareable(rw.header) || !c.fromBackend(out) {
+		return
+	}
+	c.learnVary(url, varyHeaders(rw.header))
+	if !rw.overflow {
+		cl.shared, cl.status, cl.resp, cl.body = true, rw.status, rw.header, rw.body
+	}
+}
+
+// learnVary remembers the request headers the responses to the URL vary on.
+func (c *Coalescer) learnVary(url string, vary []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(vary) == 0 {
+		delete(c.vary, url)
+		return
+	}
+	if _, ok := c.vary[url]; !ok && len(c.vary) >= maxLearnedVary {
+		clear(c.vary)
+	}
+	c.vary[url] = vary
+}
+
+// wait answers the request with the response of the call, or with next when the response can't be
+// shared, varies on headers differing between the requests, or doesn't come within the max wait.
+func (c *Coalescer) wait(w http.ResponseWriter, r *http.Request, cl *call, next http.HandlerFunc) {
+	timer := time.NewTimer(c.maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-cl.done:
+		if cl.shared && sameVariant(cl.resp, cl.header, r.Header) {
+			h := w.Header()
+			copyHeader(h, cl.resp)
+			h.Set("Content-Length", strconv.Itoa(len(cl.body)))
+			w.WriteHeader(cl.status)
+			w.Write(cl.body)
+			return
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	next(w, r)
+}
+
+// coalescable reports whether the request may be answered with the response of another client.
+func coalescable(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return false
+	}
+	return !parseCacheControl(r.Header).has("no-store")
+}
+
+// shareable reports whether the response may be given to other clients.
+func shareable(header http.Header) bool {
+	cc := parseCacheControl(header)
+	if cc.has("private") || cc.has("no-store") {
+		return false
+	}
+	return header.Get("Vary") != "*" && header.Get("Set-Cookie") == "" && header.Get("Trailer") == ""
+}
+
+// sameVariant reports whether the requests select the same variant of the response.
+func sameVariant(resp, a, b http.Header) bool {
+	for _, name := range varyHeaders(resp) {
+		if !slices.Equal(a.Values(name), b.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+)
+
+type answeredKey struct{}
+
+// withAnswered marks the request so that fromBackend tells whether the backend answered it.
+func withAnswered(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), answeredKey{}, new(atomic.Bool)))
+}
+
+func fromBackend(r *http.Request) bool {
+	answered, ok := r.Context().Value(answeredKey{}).(*atomic.Bool)
+	return ok && answered.Load()
+}
+
+// newCoalescedBackend returns a backend answering once released, and the coalescer in front of it.
+func newCoalescedBackend(t *testing.T) (*testBackend, *Coalescer, chan struct{}) {
+	t.Helper()
+	release := make(chan struct{})
+	b := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "hello")
+	})
+	b.proxy.ModifyResponse = func(resp *http.Response) error {
+		if answered, ok := resp.Request.Context().Value(answeredKey{}).(*atomic.Bool); ok {
+			answered.Store(true)
+		}
+		return nil
+	}
+	return b, NewCoalescer(&config.Coalesce{}, fromBackend, 0), release
+}
+
+// coalesce sends concurrent requests through the coalescer once the first one reached the backend.
+func coalesce(t *testing.T, c *Coalescer, b *testBackend, leader *http.Request, waiters int, release chan struct{}) []*httptest.ResponseRecorder {
+	t.Helper()
+	responses := make([]*httptest.ResponseRecorder, waiters+1)
+	var wg sync.WaitGroup
+	serve := func(i int, r *http.Request) {
+		defer wg.Done()
+		responses[i] = httptest.NewRecorder()
+		c.ServeHTTP(responses[i], withAnswered(r), b.proxy.ServeHTTP)
+	}
+
+	wg.Add(1)
+	go serve(0, leader)
+	for deadline := time.Now().Add(2 * time.Second); b.requests.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("leader request didn't reach the backend")
+		}
+	}
+	for i := 1; i <= waiters; i++ {
+		wg.Add(1)
+		go serve(i, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	}
+	// The waiting requests join the call in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return responses
+}
+
+func TestCoalescer(t *testing.T) {
+	b, c, release := newCoalescedBackend(t)
+	responses := coalesce(t, c, b, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil), 5, release)
+
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("response %d = %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if n := b.requests.Load(); n != 1 {
+		t.Errorf("%d requests to the backend, want 1", n)
+	}
+}
+
+func TestCoalescerLeaderCanceled(t *testing.T) {
+	b, c, release := newCoalescedBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := httptest.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/page", nil)
+	go func() {
+		for b.requests.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	responses := coalesce(t, c, b, leader, 3, release)
+
+	// The client of the leader going away doesn't fail the waiting requests.
+	for i, w := range responses[1:] {
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("waiting response %d = %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if n := b.requests.Load(); n != 1 {
+		t.Errorf("%d requests to the backend, want 1", n)
+	}
+}
+
+func TestCoalescerDoesNotShareErrorPages(t *testing.T) {
+	b, c, release := newCoalescedBackend(t)
+	b.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.requests.Add(1)
+		<-release
+		if r.Header.Get("X-Fail") != "" {
+			// The connection breaks, the balancer answering with its error page.
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, "hello")
+	})
+	leader := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	leader.Header.Set("X-Fail", "1")
+	responses := coalesce(t, c, b, leader, 3, release)
+
+	if responses[0].Code != http.StatusBadGateway {
+		t.Errorf("leader response = %d, want 502", responses[0].Code)
+	}
+	// The waiting requests go to the backends themselves.
+	for i, w := range responses[1:] {
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("waiting response %d = %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if n := b.requests.Load(); n != 4 {
+		t.Errorf("%d requests to the backend, want 4", n)
+	}
+}
+
+func TestCoalescerStalledBackend(t *testing.T) {
+	b, _, release := newCoalescedBackend(t)
+	// The backend only answers once the test is over.
+	t.Cleanup(func() { close(release) })
+	c := NewCoalescer(&config.Coalesce{MaxWait: 50 * time.Millisecond}, fromBackend, 100*time.Millisecond)
+
+	// The client of the leader goes away right after its request reached the backend.
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := httptest.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/page", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ServeHTTP(httptest.NewRecorder(), withAnswered(leader), b.proxy.ServeHTTP)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); b.requests.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("leader request didn't reach the backend")
+		}
+	}
+	cancel()
+
+	// The detached request gives up after the max wait and the request timeout.
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("detached request still waiting for the stalled backend")
+	}
+	c.mu.Lock()
+	calls := len(c.calls)
+	c.mu.Unlock()
+	if calls != 0 {
+		t.Errorf("%d calls in flight, want 0", calls)
+	}
+
+	// Identical requests go to the backends again instead of joining the stalled call.
+	go c.ServeHTTP(httptest.NewRecorder(), withAnswered(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)), b.proxy.ServeHTTP)
+	for deadline := time.Now().Add(2 * time.Second); b.requests.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("identical request didn't reach the backend")
+		}
+	}
+}
+
+func TestCoalescable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		want   bool
+	}{
+		{"get", http.MethodGet, header(), true},
+		{"post", http.MethodPost, header(), false},
+		{"range", http.MethodGet, header("Range", "bytes=0-10"), false},
+		{"authorization", http.MethodGet, header("Authorization", "Bearer t"), false},
+		{"cookie", http.MethodGet, header("Cookie", "id=1"), false},
+		{"no-store", http.MethodGet, header("Cache-Control", "no-store"), false},
+		{"upgrade", http.MethodGet, header("Connection", "Upgrade", "Upgrade", "websocket"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Header = tt.header
+			if got := coalescable(r); got != tt.want {
+				t.Errorf("coalescable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	diskEntryExt   = ".entry"
+	diskTempPrefix = "tmp-"
+)
+
+// DiskStore is an LRU store bounded by bytes keeping the entries in files, one per entry. The
+// index is kept in memory and rebuilt from the directory on start, so the cache survives restarts.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *diskItem, most recently used first.
+	items map[string]*list.Element
+	size  int64
+}
+
+type diskItem struct {
+	key  string
+	size int64
+}
+
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if strings.HasPrefix(file.Name(), diskTempPrefix) {
+			// Left over by an interrupted write.
+			os.Remove(path)
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskEntryExt) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		e, err := readEntry(path)
+		if err != nil || s.path(e.Key) != path {
+			os.Remove(path)
+			continue
+		}
+		s.add(e.Key, info.Size())
+	}
+	return s, nil
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	e, err := readEntry(s.path(key))
+	if err != nil {
+		s.Delete(key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *DiskStore) Set(key string, e *Entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return
+	}
+	size := int64(buf.Len())
+	if size > s.maxBytes {
+		return
+	}
+	// Readers never see partially written entries.
+	tmp, err := os.CreateTemp(s.dir, diskTempPrefix+"*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	// The file and the index are updated together, so a concurrent Set or Delete of the key can't
+	// leave a file the index doesn't account for.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if elem, ok := s.items[key]; ok {
+		s.forget(elem)
+	}
+	s.add(key, size)
+}
+
+func (s *DiskStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.forget(elem)
+		os.Remove(s.path(key))
+	}
+}
+
+func (s *DiskStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.items))
+	for key := range s.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *DiskStore) Stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items), s.size
+}
+
+// add indexes an entry and evicts the least recently used ones beyond the size. s.mu is held.
+func (s *DiskStore) add(key string, size int64) {
+	s.items[key] = s.lru.PushFront(&diskItem{key: key, size: size})
+	s.size += size
+	for s.size > s.maxBytes {
+		elem := s.lru.Back()
+		s.forget(elem)
+		os.Remove(s.path(elem.Value.(*diskItem).key))
+	}
+}
+
+// forget removes an entry from the index. s.mu is held.
+func (s *DiskStore) forget(elem *list.Element) {
+	item := s.lru.Remove(elem).(*diskItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskEntryExt)
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a cached response. Entries are immutable once stored.
+type Entry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time // RequestTime is when the request of the response was sent.
+	ResponseTime time.Time // ResponseTime is when the response was received.
+	Vary         []string  // Vary are the request headers selecting the variants stored under the key, set on variant markers only.
+}
+
+// isVariants reports whether the entry only points to the variants of a response varying on
+// request headers.
+func (e *Entry) isVariants() bool {
+	return e.Status == 0
+}
+
+// size is the approximate memory used by the entry.
+func (e *Entry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body) + 64)
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	for _, name := range e.Vary {
+		n += int64(len(name))
+	}
+	return n
+}
+
+// age is the current age of the response, following RFC 9111 section 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	age := time.Duration(0)
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		age = max(age, e.ResponseTime.Sub(date))
+	}
+	return age + e.ResponseTime.Sub(e.RequestTime) + now.Sub(e.ResponseTime)
+}
+
+// lifetime is the freshness lifetime of the response, from its s-maxage, max-age or Expires, or
+// the default TTL of the cache.
+func (e *Entry) lifetime(defaultTTL time.Duration) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates, like 0, mean already expired.
+			return 0
+		}
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = e.ResponseTime
+		}
+		return max(t.Sub(date), 0)
+	}
+	return defaultTTL
+}
+
+// staleWindow returns how long after expiring the response can be served for the directive,
+// stale-while-revalidate or stale-if-error, or the default window. Responses that must be
+// revalidated can't be served stale.
+func (e *Entry) staleWindow(directive string, defaultWindow time.Duration) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage") || cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.duration(directive); ok {
+		return d
+	}
+	return defaultWindow
+}
+
+// hasValidators reports whether the response can be revalidated with a conditional request.
+func (e *Entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// refreshed returns the entry updated with the headers of a 304 Not Modified response.
+func (e *Entry) refreshed(header http.Header, requestTime, responseTime time.Time) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = slices.Clone(values)
+	}
+	// The age of the revalidated response starts over.
+	updated.Header.Del("Age")
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// cacheControl are the directives of Cache-Control headers, lowercased.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheableStatus are the status codes cacheable by default, RFC 9110 section 15.1.
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// storable reports whether a shared cache may store the response to the request,
+// following RFC 9111 section 3.
+func storable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || !cacheableStatus[status] {
+		return false
+	}
+	if parseCacheControl(r.Header).has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if header.Get("Vary") == "*" || header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	return true
+}
+
+// varyHeaders returns the canonical names of the request headers the response varies on.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
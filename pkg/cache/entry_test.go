@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func header(pairs ...string) http.Header {
+	h := make(http.Header)
+	for i := 0; i < len(pairs); i += 2 {
+		h.Add(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestEntryLifetime(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"default TTL", header(), time.Minute},
+		{"max-age", header("Cache-Control", "max-age=30"), 30 * time.Second},
+		{"s-maxage over max-age", header("Cache-Control", "max-age=30, s-maxage=90"), 90 * time.Second},
+		{"quoted max-age", header("Cache-Control", `max-age="45"`), 45 * time.Second},
+		{"invalid max-age", header("Cache-Control", "max-age=soon"), 0},
+		{"no-cache", header("Cache-Control", "no-cache, max-age=30"), 0},
+		{"expires from date", header("Date", date, "Expires", now.Add(2*time.Hour).Format(http.TimeFormat)), 2 * time.Hour},
+		{"expires in the past", header("Date", date, "Expires", now.Add(-time.Hour).Format(http.TimeFormat)), 0},
+		{"invalid expires", header("Expires", "0"), 0},
+		{"max-age over expires", header("Cache-Control", "max-age=10", "Expires", now.Add(time.Hour).Format(http.TimeFormat)), 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Entry{Header: tt.header, ResponseTime: now}
+			if got := e.lifetime(time.Minute); got != tt.want {
+				t.Errorf("lifetime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryAge(t *testing.T) {
+	requested := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	received := requested.Add(2 * time.Second)
+	tests := []struct {
+		name   string
+		header http.Header
+		now    time.Time
+		want   time.Duration
+	}{
+		{"resident time and delay", header(), received.Add(10 * time.Second), 12 * time.Second},
+		{"age header", header("Age", "100"), received, 102 * time.Second},
+		{"date older than age", header("Age", "5", "Date", received.Add(-time.Minute).Format(http.TimeFormat)), received, 62 * time.Second},
+		{"date in the future", header("Date", received.Add(time.Hour).Format(http.TimeFormat)), received, 2 * time.Second},
+		{"invalid age", header("Age", "-3"), received, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Entry{Header: tt.header, RequestTime: requested, ResponseTime: received}
+			if got := e.age(tt.now); got != tt.want {
+				t.Errorf("age = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		request http.Header
+		status  int
+		header  http.Header
+		want    bool
+	}{
+		{"ok", http.MethodGet, header(), 200, header(), true},
+		{"cacheable error", http.MethodGet, header(), 404, header(), true},
+		{"uncacheable status", http.MethodGet, header(), 500, header("Cache-Control", "max-age=60"), false},
+		{"head", http.MethodHead, header(), 200, header(), false},
+		{"request no-store", http.MethodGet, header("Cache-Control", "no-store"), 200, header(), false},
+		{"no-store", http.MethodGet, header(), 200, header("Cache-Control", "no-store"), false},
+		{"private", http.MethodGet, header(), 200, header("Cache-Control", "private, max-age=60"), false},
+		{"vary star", http.MethodGet, header(), 200, header("Vary", "*"), false},
+		{"set-cookie", http.MethodGet, header(), 200, header("Set-Cookie", "id=1"), false},
+		{"trailers", http.MethodGet, header(), 200, header("Trailer", "X-Checksum"), false},
+		{"authorization", http.MethodGet, header("Authorization", "Bearer t"), 200, header("Cache-Control", "max-age=60"), false},
+		{"public authorization", http.MethodGet, header("Authorization", "Bearer t"), 200, header("Cache-Control", "public, max-age=60"), true},
+		{"s-maxage authorization", http.MethodGet, header("Authorization", "Bearer t"), 200, header("Cache-Control", "s-maxage=60"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Header = tt.request
+			if got := storable(r, tt.status, tt.header); got != tt.want {
+				t.Errorf("storable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := &Entry{Status: 200, Header: header("ETag", `"v1"`, "Last-Modified", lastModified.Format(http.TimeFormat))}
+	tests := []struct {
+		name    string
+		entry   *Entry
+		request http.Header
+		want    bool
+	}{
+		{"unconditional", entry, header(), false},
+		{"matching etag", entry, header("If-None-Match", `"v1"`), true},
+		{"etag in list", entry, header("If-None-Match", `"v0", "v1"`), true},
+		{"weak etag", entry, header("If-None-Match", `W/"v1"`), true},
+		{"any etag", entry, header("If-None-Match", "*"), true},
+		{"other etag", entry, header("If-None-Match", `"v2"`), false},
+		{"etag over date", entry, header("If-None-Match", `"v2"`, "If-Modified-Since", lastModified.Format(http.TimeFormat)), false},
+		{"not modified since", entry, header("If-Modified-Since", lastModified.Format(http.TimeFormat)), true},
+		{"modified since", entry, header("If-Modified-Since", lastModified.Add(-time.Second).Format(http.TimeFormat)), false},
+		{"invalid date", entry, header("If-Modified-Since", "yesterday"), false},
+		{"without etag", &Entry{Status: 200, Header: header()}, header("If-None-Match", `"v1"`), false},
+		{"not a 200", &Entry{Status: 404, Header: entry.Header}, header("If-None-Match", `"v1"`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.request
+			if got := notModified(r, tt.entry); got != tt.want {
+				t.Errorf("notModified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
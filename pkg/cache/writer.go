@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// responseWriter forwards the response of the backends to the client while keeping a copy of it
+// to store or share. Responses replaced by the cached entry, a 304 to a revalidation or an error
+// served stale, are swallowed instead.
+type responseWriter struct {
+	w             http.ResponseWriter
+	header        http.Header
+	maxBytes      int64
+	cacheStatus   string // cacheStatus is sent in X-Cache, if set.
+	revalidating  bool   // revalidating swallows 304 responses to the conditional request of the cache.
+	staleOnError  bool   // staleOnError swallows error responses.
+	status        int
+	body          []byte
+	overflow      bool // overflow is set when the body is too large to be kept.
+	detached      bool // detached keeps reading the response once the client is gone, for other requests.
+	swallowed     bool
+	headerWritten bool
+}
+
+func newResponseWriter(w http.ResponseWriter, maxBytes int64) *responseWriter {
+	return &responseWriter{w: w, header: make(http.Header), maxBytes: maxBytes}
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.headerWritten {
+		return
+	}
+	if status >= 100 && status < 200 {
+		// Informational responses, e.g. 103 Early Hints, are forwarded as is.
+		copyHeader(rw.w.Header(), rw.header)
+		rw.w.WriteHeader(status)
+		return
+	}
+	rw.headerWritten = true
+	rw.status = status
+	if (status == http.StatusNotModified && rw.revalidating) || (status >= 500 && rw.staleOnError) {
+		rw.swallowed = true
+		return
+	}
+	copyHeader(rw.w.Header(), rw.header)
+	if rw.cacheStatus != "" {
+		rw.w.Header().Set("X-Cache", rw.cacheStatus)
+	}
+	rw.w.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.swallowed {
+		return len(b), nil
+	}
+	if !rw.overflow {
+		if int64(len(rw.body)+len(b)) > rw.maxBytes {
+			rw.overflow, rw.body = true, nil
+		} else {
+			rw.body = append(rw.body, b...)
+		}
+	}
+	n, err := rw.w.Write(b)
+	if err != nil && rw.detached && !rw.overflow {
+		return len(b), nil
+	}
+	return n, err
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.swallowed {
+		http.NewResponseController(rw.w).Flush()
+	}
+}
+
+// finish forwards the trailers set after the body.
+func (rw *responseWriter) finish() {
+	if rw.swallowed || !rw.headerWritten {
+		return
+	}
+	dst := rw.w.Header()
+	for name, values := range rw.header {
+		if _, ok := dst[name]; !ok && (strings.HasPrefix(name, http.TrailerPrefix) || declaredTrailer(dst, name)) {
+			dst[name] = slices.Clone(values)
+		}
+	}
+}
+
+// statusWriter records the status of a response passed through, 0 until one is written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 && status >= 200 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// bufferWriter keeps the response to a background revalidation.
+type bufferWriter struct {
+	header        http.Header
+	status        int
+	body          []byte
+	maxBytes      int64
+	overflow      bool
+	headerWritten bool
+}
+
+func (bw *bufferWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if bw.headerWritten || (status >= 100 && status < 200) {
+		return
+	}
+	bw.headerWritten = true
+	bw.status = status
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	if !bw.headerWritten {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.overflow {
+		if int64(len(bw.body)+len(b)) > bw.maxBytes {
+			bw.overflow, bw.body = true, nil
+		} else {
+			bw.body = append(bw.body, b...)
+		}
+	}
+	return len(b), nil
+}
+
+func (bw *bufferWriter) Flush() {}
+
+// copyHeader copies the header values, so that the stored and live responses don't share them.
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = slices.Clone(values)
+	}
+}
+
+func declaredTrailer(h http.Header, name string) bool {
+	for _, value := range h.Values("Trailer") {
+		for _, trailer := range strings.Split(value, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(trailer)) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,25 +3,118 @@ package config
 import "time"
 
 type VgoBalancer struct {
-	Host     string    `yaml:"host,omitempty"` // Host is the host address where the balancer is accessible.
-	Port     int       `yaml:"port"`           // Port is the port number on which the balancer listens.
-	Services []Service `yaml:"services"`       // Services is a list of services
+	Host           string         `yaml:"host,omitempty"`             // Host is the host address where the balancer is accessible.
+	Port           int            `yaml:"port"`                       // Port is the port number on which the balancer listens.
+	Services       []Service      `yaml:"services"`                   // Services is a list of services
+	TrustedProxies []string       `yaml:"trusted_proxies,omitempty"`  // CIDRs of the proxies whose forwarding headers are trusted.
+	ClientIPHeader string         `yaml:"client_ip_header,omitempty"` // The header the trusted proxies forward the client IP in. e.g. x-forwarded-for (default), forwarded, x-real-ip
+	ProxyProtocol  *ProxyProtocol `yaml:"proxy_protocol,omitempty"`   // ProxyProtocol is the PROXY protocol configuration of the listener.
+	TLS            *TLS           `yaml:"tls,omitempty"`              // TLS serves HTTPS and HTTP/2 over TLS on the listener.
+	H2C            bool           `yaml:"h2c"`                        // H2C accepts cleartext HTTP/2, with prior knowledge or upgrade.
+	MaxStreams     uint32         `yaml:"max_concurrent_streams"`     // The maximum number of concurrent HTTP/2 streams per client connection.
+	Admin          *Admin         `yaml:"admin,omitempty"`            // Admin serves the admin API on a separate listener.
+	ShutdownDelay  time.Duration  `yaml:"shutdown_delay,omitempty"`   // The time the balancer reports not ready before draining connections on shutdown.
+	ErrorPages     ErrorPages     `yaml:"error_pages,omitempty"`      // ErrorPages are the default error responses of the services.
+}
+
+type Admin struct {
+	Host  string `yaml:"host,omitempty"`  // Host is the address the admin API listens on. (default 127.0.0.1)
+	Port  int    `yaml:"port"`            // Port is the port the admin API listens on.
+	Token string `yaml:"token,omitempty"` // Token is the bearer token required by the requests changing the state of the services.
+
+	MinHealthyBackends int `yaml:"min_healthy_backends,omitempty"` // The healthy backends every service needs for the balancer to be ready. (default 1)
+}
+
+type TLS struct {
+	CertFile string `yaml:"cert_file"` // The path of the PEM certificate, with its chain.
+	KeyFile  string `yaml:"key_file"`  // The path of the PEM private key.
+}
+
+type ProxyProtocol struct {
+	Enabled        bool          `yaml:"enabled"`                   // Accept PROXY protocol v1 and v2 headers.
+	Required       bool          `yaml:"required"`                  // Reject connections from trusted sources without a header.
+	TrustedSources []string      `yaml:"trusted_sources,omitempty"` // CIDRs allowed to send a header, required when enabled.
+	HeaderTimeout  time.Duration `yaml:"header_timeout"`            // The maximum time to wait for the header. e.g. 5s
 }
 
 type Backend struct {
-	URL            string `yaml:"url"`            // URL is the URL of the backend
-	Weight         int    `yaml:"weight"`         // Weight is the weight of the backend
-	ConnectionPool *Pool  `yaml:"pool,omitempty"` // The Connection pool configuration.
-	MaxConnection  int    `yaml:"max_connection"` // MaxConnection is the maximum number of connections allowed.
+	URL            string `yaml:"url"`                    // URL is the URL of the backend
+	Weight         int    `yaml:"weight"`                 // Weight is the weight of the backend
+	ConnectionPool *Pool  `yaml:"pool,omitempty"`         // The Connection pool configuration.
+	MaxConnection  int    `yaml:"max_connection"`         // MaxConnection is the maximum number of connections allowed.
+	ProxyProtocol  string `yaml:"proxy_protocol"`         // The PROXY protocol version sent to the backend. e.g. v1, v2
+	Protocol       string `yaml:"protocol"`               // The HTTP protocol spoken to the backend. e.g. h1 (default), h2, h2c
+	MaxStreams     int    `yaml:"max_concurrent_streams"` // The concurrent streams allowed per HTTP/2 connection by the backend.
 }
 
 type Service struct {
-	Name           string        `yaml:"name"`                   // Unique name of the service.
-	Headers        Header        `yaml:"headers,omitempty"`      // Headers is a list of headers to be added to the request.
-	Backends       []Backend     `yaml:"backends"`               // Backends is a list of backends.
-	RequestTimeout time.Duration `yaml:"request_timeout"`        // RequestTimeout is the timeout for the request. e.g. 60s
-	LBtype         string        `yaml:"lb_type"`                // Load balancing policy.
-	HealthCheck    *HealthCheck  `yaml:"health_check,omitempty"` // HealthCheck is the health check configuration.
+	Name           string                 `yaml:"name"`                        // Unique name of the service.
+	Mode           string                 `yaml:"mode,omitempty"`              // The type of traffic balanced. e.g. http (default), grpc, tcp, udp
+	Listen         string                 `yaml:"listen,omitempty"`            // The address the grpc, tcp and udp services listen on. e.g. :5432
+	IdleTimeout    time.Duration          `yaml:"idle_timeout,omitempty"`      // The timeout of tcp connections without traffic. e.g. 5m
+	SessionTimeout time.Duration          `yaml:"session_timeout,omitempty"`   // The timeout of udp sessions without traffic. e.g. 30s
+	Headers        Header                 `yaml:"headers,omitempty"`           // Headers is a list of headers to be added to the request.
+	Backends       []Backend              `yaml:"backends"`                    // Backends is a list of backends.
+	RequestTimeout time.Duration          `yaml:"request_timeout"`             // RequestTimeout is the timeout for the request. e.g. 60s
+	LBtype         string                 `yaml:"lb_type"`                     // Load balancing policy.
+	LBOptions      map[string]interface{} `yaml:"lb_options,omitempty"`        // Options of the load balancing policy.
+	HealthCheck    *HealthCheck           `yaml:"health_check,omitempty"`      // HealthCheck is the health check configuration.
+	Discovery      *Discovery             `yaml:"discovery,omitempty"`         // Discovery is the dynamic backend discovery configuration.
+	SlowStart      *SlowStart             `yaml:"slow_start,omitempty"`        // SlowStart is the warm-up configuration for recovered and new backends.
+	Forwarding     *Forwarding            `yaml:"forwarded_headers,omitempty"` // Forwarding controls the forwarding headers sent to the backends.
+	ErrorPages     ErrorPages             `yaml:"error_pages,omitempty"`       // ErrorPages override the default error responses for the service.
+	Maintenance    *Maintenance           `yaml:"maintenance,omitempty"`       // Maintenance answers requests without the backends, e.g. during planned maintenance.
+	Cache          *Cache                 `yaml:"cache,omitempty"`             // Cache stores the cacheable responses of http services.
+	Coalesce       *Coalesce              `yaml:"coalesce,omitempty"`          // Coalesce collapses identical concurrent GET requests of http services.
+}
+
+type Coalesce struct {
+	MaxWait  time.Duration `yaml:"max_wait,omitempty"`  // How long requests wait for the response of an identical one. default is 5s.
+	MaxBytes int64         `yaml:"max_bytes,omitempty"` // The maximum size of a shared response body in bytes. default is 1MiB.
+}
+
+type Cache struct {
+	MaxBytes             int64         `yaml:"max_bytes,omitempty"`              // The maximum size of the cache in bytes. default is 64MiB.
+	MaxObjectBytes       int64         `yaml:"max_object_bytes,omitempty"`       // The maximum size of a cached response body in bytes. default is 1MiB.
+	Dir                  string        `yaml:"dir,omitempty"`                    // The directory keeping the cache on disk instead of in memory.
+	DefaultTTL           time.Duration `yaml:"default_ttl,omitempty"`            // The freshness of responses without Cache-Control max-age or Expires. e.g. 1m
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate,omitempty"` // How long expired responses are served while refreshed, unless set by the response.
+	StaleIfError         time.Duration `yaml:"stale_if_error,omitempty"`         // How long expired responses are served when the backends fail, unless set by the response.
+}
+
+type Maintenance struct {
+	Enabled      bool          `yaml:"enabled"`                 // Enabled puts the service in maintenance, it can also be toggled at runtime.
+	RetryAfter   time.Duration `yaml:"retry_after,omitempty"`   // The Retry-After sent to the clients. e.g. 10m
+	AllowedIPs   []string      `yaml:"allowed_ips,omitempty"`   // CIDRs or IP addresses of the clients still served by the backends.
+	BypassHeader string        `yaml:"bypass_header,omitempty"` // The header letting requests through, with the bypass value.
+	BypassValue  string        `yaml:"bypass_value,omitempty"`  // The secret value of the bypass header.
+}
+
+// ErrorPages are error responses keyed by error. e.g. no_backend, unknown_service, upstream_timeout,
+// upstream_connect, maintenance
+type ErrorPages map[string]ErrorPage
+
+type ErrorPage struct {
+	Status   int    `yaml:"status,omitempty"`    // The status code of the response.
+	HTML     string `yaml:"html,omitempty"`      // The template of the HTML body.
+	HTMLFile string `yaml:"html_file,omitempty"` // The path of the template of the HTML body.
+	JSON     string `yaml:"json,omitempty"`      // The template of the JSON body.
+	Text     string `yaml:"text,omitempty"`      // The template of the plain text body.
+}
+
+type Forwarding struct {
+	XForwardedFor   string `yaml:"x_forwarded_for"`   // How X-Forwarded-For is sent. e.g. append (default), replace, off
+	XForwardedProto bool   `yaml:"x_forwarded_proto"` // Send the scheme of the client request in X-Forwarded-Proto.
+	XForwardedHost  bool   `yaml:"x_forwarded_host"`  // Send the Host of the client request in X-Forwarded-Host.
+	XForwardedPort  bool   `yaml:"x_forwarded_port"`  // Send the port the client connected to in X-Forwarded-Port.
+	Forwarded       bool   `yaml:"forwarded"`         // Send the RFC 7239 Forwarded header.
+	PreserveHost    *bool  `yaml:"preserve_host"`     // Keep the Host of the client request instead of the backend host. default is true.
+}
+
+type SlowStart struct {
+	Duration         time.Duration `yaml:"duration"`           // The duration of the warm-up. e.g. 60s
+	MinWeightPercent int           `yaml:"min_weight_percent"` // The percentage of the weight a backend starts with. default is 10.
+	Aggression       float64       `yaml:"aggression"`         // The curve of the ramp up, 1 is linear and higher values ramp up faster.
 }
 
 type Pool struct {
@@ -35,12 +128,61 @@ type Header struct {
 	ResponseHeaders       map[string]string `yaml:"response_headers,omitempty"`        // ResponseHeaders is a list of headers to be added to the response.
 	RemoveRequestHeaders  []string          `yaml:"remove_request_headers,omitempty"`  // RemoveRequestHeaders is a list of headers to be removed from the request.
 	RemoveResponseHeaders []string          `yaml:"remove_response_headers,omitempty"` // RemoveResponseHeaders is a list of headers to be removed from the response.
+	RequestHeaderRules    []HeaderRule      `yaml:"request_header_rules,omitempty"`    // RequestHeaderRules are conditional headers added to the request.
+	ResponseHeaderRules   []HeaderRule      `yaml:"response_header_rules,omitempty"`   // ResponseHeaderRules are conditional headers added to the response.
+}
+
+type HeaderRule struct {
+	Name   string           `yaml:"name"`           // The name of the header.
+	Value  string           `yaml:"value"`          // The value of the header, may contain placeholders. e.g. {{client_ip}}
+	Action string           `yaml:"action"`         // Whether the value replaces or is added to existing values. e.g. set (default), append
+	When   *HeaderCondition `yaml:"when,omitempty"` // The condition to add the header, always added when empty.
+}
+
+type HeaderCondition struct {
+	PathPrefix  string `yaml:"path_prefix"`  // The prefix the request path must start with.
+	StatusCodes []int  `yaml:"status_codes"` // The response status codes the header is added for, response rules only.
 }
 
 type HealthCheck struct {
 	Endpoint        string        `yaml:"endpoint"`          // The endpoint to check the health of the service.
 	Interval        time.Duration `yaml:"interval"`          // The interval to check the health of the service.
 	Timeout         time.Duration `yaml:"timeout"`           // The timeout for the health check.
-	Retries         int           `yaml:"retries"`           // The number of retries, before marking the service as unhealthy.
-	HealthCheckType string        `yaml:"health_check_type"` // The type of health check. e.g. http, tcp
+	Retries         int           `yaml:"retries"`           // The number of retries, before marking the service as unhealthy. Deprecated: use unhealthy_threshold.
+	HealthCheckType string        `yaml:"health_check_type"` // The type of health check. e.g. http, tcp, grpc
+	GRPCService     string        `yaml:"grpc_service"`      // The service checked by grpc health checks, empty for the whole server.
+
+	HealthyThreshold   int           `yaml:"healthy_threshold,omitempty"`   // The consecutive successes marking an unhealthy backend healthy. (default 2)
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold,omitempty"` // The consecutive failures marking a healthy backend unhealthy. (default retries or 3)
+	UnhealthyInterval  time.Duration `yaml:"unhealthy_interval,omitempty"`  // The interval of the checks of failing backends. (default 5s)
+	Jitter             time.Duration `yaml:"jitter,omitempty"`              // The maximum random delay added to every interval.
+	MaxBackoff         time.Duration `yaml:"max_backoff,omitempty"`         // The maximum interval of the checks of unhealthy backends. (default interval)
+
+	Port           int               `yaml:"port,omitempty"`            // The port checked instead of the backend port.
+	Scheme         string            `yaml:"scheme,omitempty"`          // The scheme of http checks instead of the backend scheme. e.g. http, https
+	Method         string            `yaml:"method,omitempty"`          // The method of http checks. e.g. GET (default), HEAD, POST
+	Headers        map[string]string `yaml:"headers,omitempty"`         // The headers sent with http checks.
+	Body           string            `yaml:"body,omitempty"`            // The request body of http checks.
+	Host           string            `yaml:"host,omitempty"`            // The Host header of http checks instead of the backend host.
+	ExpectedStatus []string          `yaml:"expected_status,omitempty"` // The accepted status codes and ranges. e.g. 200, 2xx, 200-399 (default 2xx)
+	BodyContains   string            `yaml:"body_contains,omitempty"`   // A substring the response body must contain.
+	BodyRegex      string            `yaml:"body_regex,omitempty"`      // A regular expression the response body must match.
+	JSON           map[string]string `yaml:"json,omitempty"`            // The values expected at JSON paths of the response body. e.g. status: UP
+
+	Command []string `yaml:"command,omitempty"` // The command of exec checks and its arguments, healthy when it exits with 0.
+}
+
+type Discovery struct {
+	Type         string            `yaml:"type"`                  // The type of discovery provider. e.g. file, http
+	Path         string            `yaml:"path"`                  // The path of the file containing the backend list.
+	PollInterval time.Duration     `yaml:"poll_interval"`         // The interval to poll for changes when watching is unavailable.
+	Pool         *Pool             `yaml:"pool,omitempty"`        // The Connection pool configuration for discovered backends.
+	URL          string            `yaml:"url"`                   // The URL of the HTTP catalog listing the service instances.
+	Format       string            `yaml:"format"`                // The response format of the catalog. e.g. generic, consul
+	Scheme       string            `yaml:"scheme"`                // The scheme used to build the backend URLs. default is http.
+	Headers      map[string]string `yaml:"headers,omitempty"`     // Headers sent with every catalog request. e.g. an ACL token.
+	Wait         time.Duration     `yaml:"wait"`                  // The blocking query wait time, zero disables long-polling.
+	IndexHeader  string            `yaml:"index_header"`          // The response header carrying the blocking query index.
+	Tags         []string          `yaml:"tags,omitempty"`        // Only instances having all of these tags are used.
+	TagWeights   map[string]int    `yaml:"tag_weights,omitempty"` // The weight of instances having the tag. "weight=N" tags are also honored.
 }
@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// Supported discovery provider types
+const (
+	ProviderTypeFile = "file"
+	ProviderTypeHTTP = "http"
+)
+
+// UpdateFunc is called with the full list of backends every time the provider observes a change.
+type UpdateFunc func(backends []config.Backend)
+
+// Provider discovers the backends of a service.
+type Provider interface {
+	// Watch blocks until ctx is done, calling update whenever the backend list changes.
+	Watch(ctx context.Context, update UpdateFunc) error
+	Name() string
+}
+
+func CreateProvider(cfg *config.Discovery, logger *zap.Logger) (Provider, error) {
+	switch cfg.Type {
+	case ProviderTypeFile:
+		return NewFileProvider(cfg, logger)
+	case ProviderTypeHTTP:
+		return NewHTTPProvider(cfg, logger)
+	default:
+		return nil, fmt.Errorf("unsupported discovery provider type %q", cfg.Type)
+	}
+}
+
+// applyDefaults fills the per-backend settings the discovery source does not provide.
+func applyDefaults(backends []config.Backend, cfg *config.Discovery) []config.Backend {
+	for i := range backends {
+		if backends[i].Weight == 0 {
+			backends[i].Weight = 1
+		}
+		if backends[i].ConnectionPool == nil {
+			backends[i].ConnectionPool = cfg.Pool
+		}
+	}
+	return backends
+}
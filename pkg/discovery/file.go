@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+const DefaultPollInterval = 5 * time.Second
+
+// FileProvider reads the backend list from a JSON file and reloads it whenever the file changes.
+//
+// The file contains either a list of backends or an object with a "backends" list:
+//
+//	{"backends": [{"url": "http://10.0.0.1:8080", "weight": 10}]}
+type FileProvider struct {
+	cfg          *config.Discovery
+	path         string
+	pollInterval time.Duration
+	logger       *zap.Logger
+}
+
+type fileBackend struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type fileContent struct {
+	Backends []fileBackend `json:"backends"`
+}
+
+func NewFileProvider(cfg *config.Discovery, logger *zap.Logger) (*FileProvider, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file discovery requires a path")
+	}
+
+	p := &FileProvider{
+		cfg:          cfg,
+		path:         cfg.Path,
+		pollInterval: cfg.PollInterval,
+		logger:       logger.With(zap.String("discovery", ProviderTypeFile), zap.String("path", cfg.Path)),
+	}
+	if p.pollInterval == 0 {
+		p.pollInterval = DefaultPollInterval
+	}
+	return p, nil
+}
+
+func (p *FileProvider) Watch(ctx context.Context, update UpdateFunc) error {
+	// Fall back to polling when the file system can't notify us of changes.
+	events, err := watchFile(ctx, p.path)
+	if err != nil {
+		p.logger.Warn("File watching unavailable, falling back to polling", zap.Duration("interval", p.pollInterval), zap.Error(err))
+	}
+
+	var last []byte
+	reload := func() {
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			p.logger.Warn("Failed to read the discovery file", zap.Error(err))
+			return
+		}
+		if last != nil && bytes.Equal(data, last) {
+			return
+		}
+
+		backends, err := parseFile(data)
+		if err != nil {
+			p.logger.Warn("Failed to parse the discovery file", zap.Error(err))
+			return
+		}
+		last = data
+		p.logger.Info("Discovered backends", zap.Int("count", len(backends)))
+		update(applyDefaults(backends, p.cfg))
+	}
+
+	reload()
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-events:
+			reload()
+		case <-ticker.C:
+			// Polling also covers events missed while the file was being replaced.
+			reload()
+		}
+	}
+}
+
+func (p *FileProvider) Name() string {
+	return ProviderTypeFile
+}
+
+func parseFile(data []byte) ([]config.Backend, error) {
+	var entries []fileBackend
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		var content fileContent
+		if err := json.Unmarshal(data, &content); err != nil {
+			return nil, err
+		}
+		entries = content.Backends
+	}
+
+	backends := make([]config.Backend, 0, len(entries))
+	for _, e := range entries {
+		if e.URL == "" {
+			return nil, fmt.Errorf("backend entry without url")
+		}
+		backends = append(backends, config.Backend{URL: e.URL, Weight: e.Weight})
+	}
+	return backends, nil
+}
@@ -0,0 +1,308 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// Supported catalog response formats
+const (
+	CatalogFormatGeneric = "generic"
+	CatalogFormatConsul  = "consul"
+)
+
+const (
+	DefaultIndexHeader   = "X-Consul-Index"
+	DefaultCatalogScheme = "http"
+	catalogTimeout       = 10 * time.Second
+	minBlockingInterval  = time.Second // rate limits catalogs that answer blocking queries immediately.
+)
+
+// HTTPProvider polls an HTTP catalog (Consul, etcd gateways or any service registry exposing
+// a JSON instance list) for the instances of a service. When Wait is set, blocking queries are
+// used: the last index is sent back and the catalog holds the request until something changes.
+//
+// The generic format is a list of instances:
+//
+//	[{"address": "10.0.0.1", "port": 8080, "tags": ["v2", "weight=10"], "healthy": true}]
+//
+// The consul format is the response of /v1/health/service/<name>.
+type HTTPProvider struct {
+	cfg          *config.Discovery
+	url          *url.URL
+	format       string
+	scheme       string
+	indexHeader  string
+	pollInterval time.Duration
+	client       *http.Client
+	logger       *zap.Logger
+}
+
+type catalogInstance struct {
+	Address string
+	Port    int
+	Tags    []string
+	Healthy bool
+}
+
+type genericInstance struct {
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+	Tags    []string `json:"tags"`
+	Healthy *bool    `json:"healthy"`
+	Status  string   `json:"status"`
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string   `json:"Address"`
+		Port    int      `json:"Port"`
+		Tags    []string `json:"Tags"`
+	} `json:"Service"`
+	Checks []struct {
+		Status string `json:"Status"`
+	} `json:"Checks"`
+}
+
+func NewHTTPProvider(cfg *config.Discovery, logger *zap.Logger) (*HTTPProvider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("http discovery requires a url")
+	}
+	catalogURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog url: %w", err)
+	}
+
+	p := &HTTPProvider{
+		cfg:          cfg,
+		url:          catalogURL,
+		format:       cfg.Format,
+		scheme:       cfg.Scheme,
+		indexHeader:  cfg.IndexHeader,
+		pollInterval: cfg.PollInterval,
+		logger:       logger.With(zap.String("discovery", ProviderTypeHTTP), zap.String("url", cfg.URL)),
+	}
+	if p.format == "" {
+		p.format = CatalogFormatGeneric
+	}
+	if p.format != CatalogFormatGeneric && p.format != CatalogFormatConsul {
+		return nil, fmt.Errorf("unsupported catalog format %q", p.format)
+	}
+	if p.scheme == "" {
+		p.scheme = DefaultCatalogScheme
+	}
+	if p.indexHeader == "" {
+		p.indexHeader = DefaultIndexHeader
+	}
+	if p.pollInterval == 0 {
+		p.pollInterval = DefaultPollInterval
+	}
+
+	// Blocking queries are held by the catalog for up to the wait time.
+	p.client = &http.Client{Timeout: cfg.Wait + catalogTimeout}
+	return p, nil
+}
+
+func (p *HTTPProvider) Watch(ctx context.Context, update UpdateFunc) error {
+	var index string
+	var last []config.Backend
+	first := true
+
+	for {
+		instances, nextIndex, err := p.fetch(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			p.logger.Warn("Failed to query the catalog", zap.Error(err))
+			// Start over with a non-blocking query after an error.
+			index = ""
+			if !sleep(ctx, p.pollInterval) {
+				return nil
+			}
+			continue
+		}
+
+		backends := p.toBackends(instances)
+		if len(backends) == 0 {
+			// An empty catalog is more likely an outage of the registry than of every instance.
+			p.logger.Warn("The catalog returned no healthy instance, keeping the current backends")
+		} else if first || !reflect.DeepEqual(backends, last) {
+			first = false
+			last = backends
+			p.logger.Info("Discovered backends", zap.Int("count", len(backends)))
+			update(applyDefaults(cloneBackends(backends), p.cfg))
+		}
+
+		if p.cfg.Wait > 0 && nextIndex != "" {
+			// An index going backwards means the catalog was reset, so the index is restarted.
+			if prev, err := strconv.ParseUint(index, 10, 64); err == nil {
+				if next, err := strconv.ParseUint(nextIndex, 10, 64); err == nil && next < prev {
+					nextIndex = ""
+				}
+			}
+			unchanged := nextIndex == index
+			index = nextIndex
+			if unchanged && !sleep(ctx, minBlockingInterval) {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+
+		if !sleep(ctx, p.pollInterval) {
+			return nil
+		}
+	}
+}
+
+func (p *HTTPProvider) Name() string {
+	return ProviderTypeHTTP
+}
+
+func (p *HTTPProvider) fetch(ctx context.Context, index string) ([]catalogInstance, string, error) {
+	u := *p.url
+	if p.cfg.Wait > 0 && index != "" {
+		q := u.Query()
+		q.Set("index", index)
+		q.Set("wait", p.cfg.Wait.String())
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for key, value := range p.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("catalog returned status %d", resp.StatusCode)
+	}
+
+	var instances []catalogInstance
+	switch p.format {
+	case CatalogFormatConsul:
+		var entries []consulEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			address := e.Service.Address
+			if address == "" {
+				address = e.Node.Address
+			}
+			healthy := true
+			for _, check := range e.Checks {
+				if check.Status != "passing" {
+					healthy = false
+				}
+			}
+			instances = append(instances, catalogInstance{Address: address, Port: e.Service.Port, Tags: e.Service.Tags, Healthy: healthy})
+		}
+	default:
+		var entries []genericInstance
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			healthy := e.Healthy == nil || *e.Healthy
+			switch strings.ToLower(e.Status) {
+			case "", "passing", "healthy", "up":
+			default:
+				healthy = false
+			}
+			instances = append(instances, catalogInstance{Address: e.Address, Port: e.Port, Tags: e.Tags, Healthy: healthy})
+		}
+	}
+
+	return instances, resp.Header.Get(p.indexHeader), nil
+}
+
+// toBackends keeps the healthy instances having every required tag.
+func (p *HTTPProvider) toBackends(instances []catalogInstance) []config.Backend {
+	backends := make([]config.Backend, 0, len(instances))
+	for _, inst := range instances {
+		if !inst.Healthy || inst.Address == "" || !hasTags(inst.Tags, p.cfg.Tags) {
+			continue
+		}
+
+		host := inst.Address
+		if inst.Port != 0 {
+			host = net.JoinHostPort(inst.Address, strconv.Itoa(inst.Port))
+		}
+		u := url.URL{Scheme: p.scheme, Host: host}
+		backends = append(backends, config.Backend{URL: u.String(), Weight: p.tagWeight(inst.Tags)})
+	}
+	return backends
+}
+
+// tagWeight returns the weight of an instance from its "weight=N" tag, or the highest weight
+// configured in tag_weights for one of its tags.
+func (p *HTTPProvider) tagWeight(tags []string) int {
+	weight := 0
+	for _, tag := range tags {
+		if v, ok := strings.CutPrefix(tag, "weight="); ok {
+			if w, err := strconv.Atoi(v); err == nil && w > 0 {
+				return w
+			}
+		}
+		if w, ok := p.cfg.TagWeights[tag]; ok && w > weight {
+			weight = w
+		}
+	}
+	return weight
+}
+
+func hasTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneBackends(backends []config.Backend) []config.Backend {
+	return append([]config.Backend(nil), backends...)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,295 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// fakeCatalog is a catalog answering blocking queries like Consul: requests with the current index
+// are held until the instances change or the wait expires.
+type fakeCatalog struct {
+	mu        sync.Mutex
+	index     int
+	instances interface{}
+	changed   chan struct{}
+	status    int      // status answered instead of the instances when set.
+	queries   []string // queries are the raw queries received.
+}
+
+func newFakeCatalog(index int, instances interface{}) *fakeCatalog {
+	return &fakeCatalog{index: index, instances: instances, changed: make(chan struct{})}
+}
+
+func (c *fakeCatalog) set(index int, instances interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index, c.instances = index, instances
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeCatalog) setStatus(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+func (c *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.queries = append(c.queries, r.URL.RawQuery)
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+
+	if wait, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil && r.URL.Query().Get("index") == fmt.Sprint(index) {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+		return
+	}
+	w.Header().Set(DefaultIndexHeader, fmt.Sprint(c.index))
+	json.NewEncoder(w).Encode(c.instances)
+}
+
+func (c *fakeCatalog) lastQuery() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queries[len(c.queries)-1]
+}
+
+// watch runs the provider until the test ends, sending the updates to the returned channel.
+func watch(t *testing.T, cfg *config.Discovery) <-chan []config.Backend {
+	t.Helper()
+	p, err := NewHTTPProvider(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []config.Backend, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Watch(ctx, func(backends []config.Backend) { updates <- backends })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return updates
+}
+
+func nextUpdate(t *testing.T, updates <-chan []config.Backend) []config.Backend {
+	t.Helper()
+	select {
+	case backends := <-updates:
+		return backends
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update from the provider")
+		return nil
+	}
+}
+
+func urls(backends []config.Backend) map[string]int {
+	weights := make(map[string]int, len(backends))
+	for _, b := range backends {
+		weights[b.URL] = b.Weight
+	}
+	return weights
+}
+
+func TestHTTPProviderGeneric(t *testing.T) {
+	healthy, unhealthy := true, false
+	catalog := newFakeCatalog(1, []genericInstance{
+		{Address: "10.0.0.1", Port: 8080, Tags: []string{"prod", "weight=10"}},
+		{Address: "10.0.0.2", Port: 8080, Tags: []string{"prod", "large"}, Healthy: &healthy},
+		{Address: "10.0.0.3", Port: 8080, Tags: []string{"prod"}, Healthy: &unhealthy},
+		{Address: "10.0.0.4", Port: 8080, Tags: []string{"prod"}, Status: "critical"},
+		{Address: "10.0.0.5", Port: 8080, Tags: []string{"staging"}},
+		{Address: "10.0.0.6", Port: 8080, Tags: []string{"prod"}},
+	})
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+
+	updates := watch(t, &config.Discovery{
+		Type:         ProviderTypeHTTP,
+		URL:          srv.URL,
+		Scheme:       "https",
+		PollInterval: 10 * time.Millisecond,
+		Tags:         []string{"prod"},
+		TagWeights:   map[string]int{"large": 20},
+	})
+
+	want := map[string]int{
+		"https://10.0.0.1:8080": 10,
+		"https://10.0.0.2:8080": 20,
+		"https://10.0.0.6:8080": 1,
+	}
+	if got := urls(nextUpdate(t, updates)); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+
+	// Polls without changes don't update the pool.
+	select {
+	case backends := <-updates:
+		t.Errorf("unexpected update %v", backends)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	catalog.set(2, []genericInstance{{Address: "10.0.0.7", Port: 9090, Tags: []string{"prod"}}})
+	want = map[string]int{"https://10.0.0.7:9090": 1}
+	if got := urls(nextUpdate(t, updates)); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+}
+
+func consulInstance(address string, port int, status string) consulEntry {
+	var e consulEntry
+	e.Node.Address = address
+	e.Service.Port = port
+	e.Checks = append(e.Checks, struct {
+		Status string `json:"Status"`
+	}{status})
+	return e
+}
+
+func TestHTTPProviderBlockingQueries(t *testing.T) {
+	catalog := newFakeCatalog(5, []consulEntry{
+		consulInstance("10.0.0.1", 8080, "passing"),
+		consulInstance("10.0.0.2", 8080, "critical"),
+	})
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+
+	updates := watch(t, &config.Discovery{
+		Type:         ProviderTypeHTTP,
+		URL:          srv.URL + "/v1/health/service/api",
+		Format:       CatalogFormatConsul,
+		Wait:         2 * time.Second,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	if got, want := urls(nextUpdate(t, updates)), map[string]int{"http://10.0.0.1:8080": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+
+	// The next query blocks on the last index until the catalog changes.
+	time.Sleep(100 * time.Millisecond)
+	if got, want := catalog.lastQuery(), "index=5&wait=2s"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+	catalog.set(6, []consulEntry{
+		consulInstance("10.0.0.1", 8080, "passing"),
+		consulInstance("10.0.0.2", 8080, "passing"),
+	})
+	want := map[string]int{"http://10.0.0.1:8080": 1, "http://10.0.0.2:8080": 1}
+	if got := urls(nextUpdate(t, updates)); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+
+	// A catalog reset sends the index backwards, restarting with a non-blocking query.
+	catalog.set(1, []consulEntry{consulInstance("10.0.0.3", 8080, "passing")})
+	if got, want := urls(nextUpdate(t, updates)), map[string]int{"http://10.0.0.3:8080": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, want := catalog.lastQuery(), "index=1&wait=2s"; got != want {
+		t.Errorf("query after reset = %q, want %q", got, want)
+	}
+}
+
+func TestHTTPProviderRecoversFromErrors(t *testing.T) {
+	catalog := newFakeCatalog(1, []genericInstance{{Address: "10.0.0.1", Port: 8080}})
+	catalog.setStatus(http.StatusInternalServerError)
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+
+	updates := watch(t, &config.Discovery{
+		Type:         ProviderTypeHTTP,
+		URL:          srv.URL,
+		Wait:         time.Second,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	select {
+	case backends := <-updates:
+		t.Fatalf("unexpected update %v while the catalog fails", backends)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	catalog.mu.Lock()
+	failed := append([]string(nil), catalog.queries...)
+	catalog.mu.Unlock()
+	// After an error, the provider starts over without an index.
+	for _, q := range failed {
+		if q != "" {
+			t.Errorf("query after errors = %q, want none", q)
+		}
+	}
+
+	catalog.setStatus(0)
+	if got, want := urls(nextUpdate(t, updates)), map[string]int{"http://10.0.0.1:8080": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+}
+
+func TestHTTPProviderSubsecondWait(t *testing.T) {
+	catalog := newFakeCatalog(3, []genericInstance{{Address: "10.0.0.1", Port: 8080}})
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+
+	updates := watch(t, &config.Discovery{
+		Type:         ProviderTypeHTTP,
+		URL:          srv.URL,
+		Wait:         500 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	nextUpdate(t, updates)
+
+	time.Sleep(100 * time.Millisecond)
+	if got, want := catalog.lastQuery(), "index=3&wait=500ms"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestHTTPProviderKeepsBackendsOnEmptyCatalog(t *testing.T) {
+	catalog := newFakeCatalog(1, []genericInstance{{Address: "10.0.0.1", Port: 8080}})
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+
+	updates := watch(t, &config.Discovery{
+		Type:         ProviderTypeHTTP,
+		URL:          srv.URL,
+		PollInterval: 10 * time.Millisecond,
+	})
+	nextUpdate(t, updates)
+
+	catalog.set(2, []genericInstance{})
+	select {
+	case backends := <-updates:
+		t.Fatalf("unexpected update %v from an empty catalog", backends)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	catalog.set(3, []genericInstance{{Address: "10.0.0.2", Port: 8080}})
+	if got, want := urls(nextUpdate(t, updates)), map[string]int{"http://10.0.0.2:8080": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package discovery
+
+import (
+	"context"
+	"errors"
+)
+
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
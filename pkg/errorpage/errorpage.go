@@ -0,0 +1,230 @@
+package errorpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"strconv"
+	texttemplate "text/template"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/requestid"
+)
+
+// Kind is an error answered by the balancer itself.
+type Kind string
+
+// Errors answered by the balancer
+const (
+	NoBackend       Kind = "no_backend"       // No healthy backend is available.
+	UnknownService  Kind = "unknown_service"  // No service matches the request.
+	UpstreamTimeout Kind = "upstream_timeout" // The backend didn't answer in time.
+	UpstreamConnect Kind = "upstream_connect" // The connection to the backend failed.
+	Maintenance     Kind = "maintenance"      // The service is under maintenance.
+)
+
+// defaults are the status and message of the errors without a configured page.
+var defaults = map[Kind]struct {
+	status  int
+	message string
+}{
+	NoBackend:       {http.StatusServiceUnavailable, "No backend is available to serve the request."},
+	UnknownService:  {http.StatusNotFound, "Service not found."},
+	UpstreamTimeout: {http.StatusGatewayTimeout, "The backend didn't respond in time."},
+	UpstreamConnect: {http.StatusBadGateway, "The backend couldn't be reached."},
+	Maintenance:     {http.StatusServiceUnavailable, "The service is under maintenance."},
+}
+
+const defaultHTML = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`
+
+// Data is the error rendered by the templates.
+type Data struct {
+	Kind       Kind
+	Status     int
+	StatusText string
+	Message    string
+	Service    string
+	RequestID  string
+}
+
+// Pages renders the error responses of a service. A nil Pages renders the defaults.
+type Pages struct {
+	service string
+	pages   map[Kind]*page
+}
+
+type page struct {
+	status int
+	html   *htmltemplate.Template
+	json   *texttemplate.Template
+	text   *texttemplate.Template
+}
+
+// New compiles the error pages of a service.
+func New(pages config.ErrorPages, service string) (*Pages, error) {
+	p := &Pages{service: service, pages: make(map[Kind]*page)}
+	for name, cfg := range pages {
+		kind := Kind(name)
+		if _, ok := defaults[kind]; !ok {
+			return nil, fmt.Errorf("unknown error page %q", name)
+		}
+		compiled, err := newPage(kind, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %s: %w", name, err)
+		}
+		p.pages[kind] = compiled
+	}
+	return p, nil
+}
+
+// Merge returns the pages overridden by the pages of a service.
+func Merge(base, override config.ErrorPages) config.ErrorPages {
+	if len(base) == 0 {
+		return override
+	}
+	merged := make(config.ErrorPages, len(base)+len(override))
+	for name, p := range base {
+		merged[name] = p
+	}
+	for name, p := range override {
+		merged[name] = p
+	}
+	return merged
+}
+
+func newPage(kind Kind, cfg config.ErrorPage) (*page, error) {
+	p := &page{status: cfg.Status}
+	if p.status == 0 {
+		p.status = defaults[kind].status
+	}
+	// Error pages must not pass for a successful or redirected response.
+	if p.status < 400 || p.status > 599 {
+		return nil, fmt.Errorf("invalid status %d, error pages use 4xx and 5xx statuses", p.status)
+	}
+
+	html := cfg.HTML
+	if cfg.HTMLFile != "" {
+		content, err := os.ReadFile(cfg.HTMLFile)
+		if err != nil {
+			return nil, err
+		}
+		html = string(content)
+	}
+	var err error
+	if html != "" {
+		if p.html, err = htmltemplate.New(string(kind)).Parse(html); err != nil {
+			return nil, err
+		}
+	}
+	funcs := texttemplate.FuncMap{"json": toJSON}
+	if cfg.JSON != "" {
+		if p.json, err = texttemplate.New(string(kind)).Funcs(funcs).Parse(cfg.JSON); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Text != "" {
+		if p.text, err = texttemplate.New(string(kind)).Funcs(funcs).Parse(cfg.Text); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Write answers the request with the error, in the format preferred by the Accept header of the
+// client among JSON, HTML and plain text.
+func (p *Pages) Write(w http.ResponseWriter, r *http.Request, kind Kind) {
+	pg := p.page(kind)
+	data := Data{
+		Kind:       kind,
+		Status:     pg.status,
+		StatusText: http.StatusText(pg.status),
+		Message:    defaults[kind].message,
+		RequestID:  requestid.FromRequest(r),
+	}
+	if p != nil {
+		data.Service = p.service
+	}
+
+	var body bytes.Buffer
+	var err error
+	contentType := negotiate(r.Header.Get("Accept"), pg.preferred())
+	switch contentType {
+	case contentTypeJSON:
+		if pg.json != nil {
+			err = pg.json.Execute(&body, data)
+		} else {
+			err = json.NewEncoder(&body).Encode(map[string]interface{}{
+				"error":      string(kind),
+				"status":     data.Status,
+				"message":    data.Message,
+				"request_id": data.RequestID,
+			})
+		}
+	case contentTypeHTML:
+		tmpl := pg.html
+		if tmpl == nil {
+			tmpl = defaultHTMLTemplate
+		}
+		err = tmpl.Execute(&body, data)
+	default:
+		if pg.text != nil {
+			err = pg.text.Execute(&body, data)
+		} else {
+			body.WriteString(data.Message + "\n")
+		}
+	}
+	if err != nil {
+		// A broken template must not hide the error.
+		contentType = contentTypePlain
+		body.Reset()
+		body.WriteString(data.Message + "\n")
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add("Vary", "Accept")
+	w.WriteHeader(pg.status)
+	w.Write(body.Bytes())
+}
+
+func (p *Pages) page(kind Kind) *page {
+	if p != nil {
+		if pg, ok := p.pages[kind]; ok {
+			return pg
+		}
+	}
+	return &page{status: defaults[kind].status}
+}
+
+// preferred returns the formats with a configured template, offered to clients accepting any.
+func (p *page) preferred() []string {
+	var formats []string
+	if p.html != nil {
+		formats = append(formats, contentTypeHTML)
+	}
+	if p.json != nil {
+		formats = append(formats, contentTypeJSON)
+	}
+	return formats
+}
+
+var defaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("default").Parse(defaultHTML))
+
+// toJSON formats a value as JSON in templates, e.g. {"error": {{json .Message}}}.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
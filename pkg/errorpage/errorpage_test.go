@@ -0,0 +1,118 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/requestid"
+)
+
+func TestNewStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		want    int
+		wantErr bool
+	}{
+		{"default", 0, http.StatusServiceUnavailable, false},
+		{"client error", http.StatusTooManyRequests, http.StatusTooManyRequests, false},
+		{"highest", 599, 599, false},
+		{"success", http.StatusOK, 0, true},
+		{"redirect", http.StatusFound, 0, true},
+		{"informational", http.StatusContinue, 0, true},
+		{"out of range", 600, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, err := New(config.ErrorPages{string(NoBackend): {Status: tt.status}}, "web")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("status %d accepted", tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pages.page(NoBackend).status; got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := map[string]config.ErrorPages{
+		"unknown kind":      {"teapot": {}},
+		"invalid html":      {string(NoBackend): {HTML: "{{.Status"}},
+		"invalid json":      {string(NoBackend): {JSON: "{{json}"}},
+		"missing html file": {string(NoBackend): {HTMLFile: "/nonexistent/page.html"}},
+	}
+	for name, pages := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(pages, "web"); err == nil {
+				t.Error("invalid error pages accepted")
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	pages, err := New(config.ErrorPages{
+		string(UpstreamTimeout): {
+			Status: http.StatusServiceUnavailable,
+			JSON:   `{"error": {{json .Kind}}, "service": {{json .Service}}, "id": {{json .RequestID}}}`,
+			Text:   "{{.Status}} {{.Message}}",
+		},
+		string(NoBackend): {Text: "{{.Missing}}"},
+	}, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		pages       *Pages
+		kind        Kind
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"json template", pages, UpstreamTimeout, "application/json", 503, contentTypeJSON, `{"error": "upstream_timeout", "service": "web", "id": "req-1"}`},
+		{"text template", pages, UpstreamTimeout, "text/plain", 503, contentTypePlain, "503 The backend didn't respond in time."},
+		{"template preferred", pages, UpstreamTimeout, "*/*", 503, contentTypeJSON, `"service": "web"`},
+		{"default html", pages, UpstreamTimeout, "text/html", 503, contentTypeHTML, "<h1>503 Service Unavailable</h1>"},
+		{"default json", nil, UpstreamConnect, "application/json", 502, contentTypeJSON, `"error":"upstream_connect"`},
+		{"default text", nil, UnknownService, "", 404, contentTypePlain, "Service not found."},
+		{"broken template", pages, NoBackend, "text/plain", 503, contentTypePlain, "No backend is available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set(requestid.Header, "req-1")
+			w := httptest.NewRecorder()
+			tt.pages.Write(w, requestid.WithRequestID(r), tt.kind)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType+"; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want %s", got, tt.contentType)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.body)
+			}
+			if tt.contentType == contentTypeJSON && !json.Valid(w.Body.Bytes()) {
+				t.Errorf("invalid JSON body %q", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package errorpage
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeJSON  = "application/json"
+	contentTypeHTML  = "text/html"
+	contentTypePlain = "text/plain"
+)
+
+// negotiate picks the content type with the highest quality in the Accept header among JSON,
+// HTML and plain text. Ties, e.g. clients accepting anything, go to the preferred types first,
+// then to plain text.
+func negotiate(accept string, preferred []string) string {
+	candidates := append(append([]string{}, preferred...), contentTypePlain, contentTypeJSON, contentTypeHTML)
+	if strings.TrimSpace(accept) == "" {
+		return candidates[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, candidate := range candidates {
+		if q := quality(accept, candidate); q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	if best == "" {
+		// Nothing acceptable, an error is still better than 406.
+		return candidates[0]
+	}
+	return best
+}
+
+// quality returns the quality of the content type in the Accept header, the most specific range
+// matching it taking precedence.
+func quality(accept, contentType string) float64 {
+	mainType, _, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+
+		s := -1
+		switch {
+		case mediaRange == contentType:
+			s = 2
+		case mediaRange == mainType+"/*":
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		case contentType == contentTypeJSON && strings.HasSuffix(mediaRange, "+json"):
+			// e.g. application/problem+json
+			s = 2
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, parseQ(params)
+	}
+	return q
+}
+
+func parseQ(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 {
+			return 0
+		}
+		return min(q, 1)
+	}
+	return 1
+}
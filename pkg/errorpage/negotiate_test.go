@@ -0,0 +1,35 @@
+package errorpage
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name      string
+		accept    string
+		preferred []string
+		want      string
+	}{
+		{"no accept", "", nil, contentTypePlain},
+		{"no accept with a template", "", []string{contentTypeJSON}, contentTypeJSON},
+		{"json", "application/json", nil, contentTypeJSON},
+		{"problem json", "application/problem+json", nil, contentTypeJSON},
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", nil, contentTypeHTML},
+		{"any", "*/*", nil, contentTypePlain},
+		{"any with a template", "*/*", []string{contentTypeHTML, contentTypeJSON}, contentTypeHTML},
+		{"quality", "text/html;q=0.5, application/json", nil, contentTypeJSON},
+		{"main type range", "text/*", []string{contentTypeJSON}, contentTypePlain},
+		// The most specific range wins over the wildcards.
+		{"specific over wildcard", "text/*;q=0.9, text/plain;q=0.1, application/json;q=0.5", nil, contentTypeHTML},
+		{"refused", "application/json;q=0, */*", nil, contentTypePlain},
+		{"case insensitive", "Application/JSON", nil, contentTypeJSON},
+		{"nothing acceptable", "image/png", []string{contentTypeHTML}, contentTypeHTML},
+		{"invalid quality", "application/json;q=abc, text/html;q=0.1", nil, contentTypeHTML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiate(tt.accept, tt.preferred); got != tt.want {
+				t.Errorf("negotiate(%q, %v) = %s, want %s", tt.accept, tt.preferred, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Listener accepts connections starting with a PROXY protocol header and reports the address
+// conveyed in the header as their remote address. The header is parsed on the first use of the
+// connection, so a slow client doesn't block Accept.
+type Listener struct {
+	net.Listener
+	Trusted       func(ip net.IP) bool // Trusted reports whether a peer may send a header, nil trusts no one.
+	Required      bool                 // Required closes trusted connections without a header.
+	HeaderTimeout time.Duration        // HeaderTimeout is the maximum time to wait for the header.
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// A header sets the client address, untrusted peers would choose their own.
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || l.Trusted == nil || !l.Trusted(addr.IP) {
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), required: l.Required, timeout: timeout}, nil
+}
+
+// Conn is a connection whose remote and local addresses come from its PROXY protocol header.
+type Conn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+	timeout  time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// Header returns the PROXY protocol header of the connection, nil when it had none.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.header, c.err = ReadHeader(c.reader)
+	if errors.Is(c.err, ErrNoHeader) && !c.required {
+		c.err = nil
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// accept sends the data to a listener from a loopback connection, and returns the remote address
+// and the data seen by the listener.
+func accept(t *testing.T, l *Listener, data string) (string, string, error) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	l.Listener = inner
+	if l.HeaderTimeout == 0 {
+		l.HeaderTimeout = time.Second
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, data)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	received, err := io.ReadAll(conn)
+	return conn.RemoteAddr().String(), string(received), err
+}
+
+func TestListener(t *testing.T) {
+	const header = "PROXY TCP4 192.0.2.1 10.0.0.1 51234 443\r\n"
+	loopback := func(ip net.IP) bool { return ip.IsLoopback() }
+	nobody := func(ip net.IP) bool { return false }
+
+	tests := []struct {
+		name     string
+		listener *Listener
+		data     string
+		wantAddr string
+		wantData string
+		wantErr  bool
+	}{
+		{"trusted", &Listener{Trusted: loopback}, header + "hello", "192.0.2.1:51234", "hello", false},
+		{"trusted without header", &Listener{Trusted: loopback}, "hello", "", "hello", false},
+		{"required", &Listener{Trusted: loopback, Required: true}, "hello", "", "", true},
+		{"malformed", &Listener{Trusted: loopback}, "PROXY TCP4 nope\r\nhello", "", "", true},
+		// Untrusted peers can't choose their address, the header is passed on as data.
+		{"untrusted", &Listener{Trusted: nobody}, header + "hello", "", header + "hello", false},
+		{"no trusted sources", &Listener{}, header + "hello", "", header + "hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, data, err := accept(t, tt.listener, tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("read %q from %s, want an error", data, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantAddr != "" && addr != tt.wantAddr {
+				t.Errorf("remote address = %s, want %s", addr, tt.wantAddr)
+			}
+			if tt.wantAddr == "" {
+				if ip := net.ParseIP(hostOf(addr)); ip == nil || !ip.IsLoopback() {
+					t.Errorf("remote address = %s, want the peer", addr)
+				}
+			}
+			if data != tt.wantData {
+				t.Errorf("data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestListenerHeaderTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	l := &Listener{Listener: inner, Trusted: func(net.IP) bool { return true }, HeaderTimeout: 50 * time.Millisecond}
+
+	// A peer that never sends its header doesn't hold the connection.
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	io.WriteString(client, "PROXY ")
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("read succeeded without a complete header")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("header timeout not applied")
+	}
+}
+
+func hostOf(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
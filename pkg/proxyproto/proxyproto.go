@@ -0,0 +1,207 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Supported PROXY protocol versions
+const (
+	Version1 = "v1"
+	Version2 = "v2"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // the longest v1 header, CRLF included.
+	v2HeaderLen = 16
+	v2MaxLength = 4096 // bounds the memory a peer makes the listener allocate, TLVs included.
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamTCP4 = 0x11
+	v2FamTCP6 = 0x21
+	v2FamUDP4 = 0x12
+	v2FamUDP6 = 0x22
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader is returned when the connection doesn't start with a PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+// Header is a parsed PROXY protocol header. Source and Destination are nil when the sender
+// didn't convey the addresses, e.g. for health checks of the sending proxy itself.
+type Header struct {
+	Version     string
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader reads a v1 or v2 header from r. ErrNoHeader is returned, without consuming any
+// byte, when the data doesn't start with a header.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	if sig, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if prefix, err := r.Peek(len(v1Prefix)); err == nil && string(prefix) == v1Prefix {
+		return readV1(r)
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: Version1}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+
+	ipv4 := fields[1] == "TCP4"
+	src, err := parseV1Addr(fields[2], fields[4], ipv4)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5], ipv4)
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: Version1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(ip, port string, ipv4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || strings.Contains(ip, ":") == ipv4 {
+		return nil, fmt.Errorf("proxyproto: invalid v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	head := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", head[12]>>4)
+	}
+	command := head[12] & 0x0f
+	family := head[13]
+	length := binary.BigEndian.Uint16(head[14:16])
+	if length > v2MaxLength {
+		return nil, fmt.Errorf("proxyproto: v2 header of %d bytes too long", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: Version2}
+	if command == v2CmdLocal {
+		return h, nil
+	}
+	if command != v2CmdProxy {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 command %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case v2FamTCP4, v2FamUDP4:
+		ipLen = net.IPv4len
+	case v2FamTCP6, v2FamUDP6:
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable address.
+		return h, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("proxyproto: v2 address block too short")
+	}
+
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if family == v2FamUDP4 || family == v2FamUDP6 {
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return h, nil
+}
+
+// WriteHeader writes a PROXY protocol header conveying the src and dst TCP addresses.
+func WriteHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	valid := srcOK && dstOK && (srcTCP.IP.To4() == nil) == (dstTCP.IP.To4() == nil)
+
+	switch version {
+	case Version1:
+		if !valid {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP6"
+		if srcTCP.IP.To4() != nil {
+			proto = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)
+		return err
+	case Version2:
+		buf := bytes.NewBuffer(append([]byte(nil), v2Signature...))
+		if !valid {
+			buf.Write([]byte{0x20 | v2CmdLocal, 0x00, 0x00, 0x00})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+
+		family, srcIP, dstIP := byte(v2FamTCP6), srcTCP.IP.To16(), dstTCP.IP.To16()
+		if ip4 := srcTCP.IP.To4(); ip4 != nil {
+			family, srcIP, dstIP = v2FamTCP4, ip4, dstTCP.IP.To4()
+		}
+		buf.Write([]byte{0x20 | v2CmdProxy, family})
+		binary.Write(buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(buf, binary.BigEndian, uint16(srcTCP.Port))
+		binary.Write(buf, binary.BigEndian, uint16(dstTCP.Port))
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return fmt.Errorf("proxyproto: unsupported version %q", version)
+	}
+}
@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2Header builds a v2 header with the command, family and payload, its length field set to
+// length unless negative.
+func v2Header(command, family byte, payload []byte, length int) []byte {
+	if length < 0 {
+		length = len(payload)
+	}
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, 0x20|command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	return append(b, payload...)
+}
+
+func tcp4Payload() []byte {
+	p := []byte{192, 0, 2, 1, 10, 0, 0, 1}
+	p = binary.BigEndian.AppendUint16(p, 51234)
+	return binary.BigEndian.AppendUint16(p, 443)
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	tcp6 = binary.BigEndian.AppendUint16(tcp6, 1000)
+	tcp6 = binary.BigEndian.AppendUint16(tcp6, 2000)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		source  string
+		wantErr string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 443\r\n"), "192.0.2.1:51234", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\n"), "[2001:db8::1]:1000", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 without CRLF", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 443\n"), "", "not CRLF terminated"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", "too long"},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), "", io.EOF.Error()},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234\r\n"), "", "invalid v1 header"},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 10.0.0.1 51234 443\r\n"), "", "invalid v1 header"},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2.999 10.0.0.1 51234 443\r\n"), "", "invalid v1 address"},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 51234 443\r\n"), "", "invalid v1 address"},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 65536 443\r\n"), "", "invalid v1 port"},
+		{"v2 tcp4", v2Header(v2CmdProxy, v2FamTCP4, tcp4Payload(), -1), "192.0.2.1:51234", ""},
+		{"v2 tcp6", v2Header(v2CmdProxy, v2FamTCP6, tcp6, -1), "[2001:db8::1]:1000", ""},
+		{"v2 with TLVs", v2Header(v2CmdProxy, v2FamTCP4, append(tcp4Payload(), 0x04, 0x00, 0x01, 0x00), -1), "192.0.2.1:51234", ""},
+		{"v2 local", v2Header(v2CmdLocal, 0x00, nil, -1), "", ""},
+		{"v2 unspecified family", v2Header(v2CmdProxy, 0x00, nil, -1), "", ""},
+		{"v2 truncated header", v2Header(v2CmdProxy, v2FamTCP4, nil, -1)[:14], "", io.ErrUnexpectedEOF.Error()},
+		{"v2 truncated payload", v2Header(v2CmdProxy, v2FamTCP4, tcp4Payload()[:6], 12), "", io.ErrUnexpectedEOF.Error()},
+		{"v2 short address block", v2Header(v2CmdProxy, v2FamTCP6, tcp4Payload(), -1), "", "address block too short"},
+		{"v2 oversized", v2Header(v2CmdProxy, v2FamTCP4, tcp4Payload(), 0xffff), "", "too long"},
+		{"v2 unknown version", append(append(append([]byte(nil), v2Signature...), 0x11, v2FamTCP4, 0, 12), tcp4Payload()...), "", "unsupported v2 version"},
+		{"v2 unknown command", v2Header(0x2, v2FamTCP4, tcp4Payload(), -1), "", "unsupported v2 command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := ""
+			if h.Source != nil {
+				source = h.Source.String()
+			}
+			if source != tt.source {
+				t.Errorf("source = %q, want %q", source, tt.source)
+			}
+		})
+	}
+}
+
+func TestReadHeaderNoHeader(t *testing.T) {
+	for _, input := range []string{"GET / HTTP/1.1\r\n\r\n", "PROX", ""} {
+		r := bufio.NewReader(strings.NewReader(input))
+		if _, err := ReadHeader(r); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("ReadHeader(%q) error = %v, want ErrNoHeader", input, err)
+		}
+		// Nothing is consumed.
+		if rest, _ := io.ReadAll(r); string(rest) != input {
+			t.Errorf("ReadHeader(%q) consumed the data, %q left", input, rest)
+		}
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	for _, version := range []string{Version1, Version2} {
+		t.Run(version, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			h, err := ReadHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Version != version || h.Source.String() != src.String() || h.Destination.String() != dst.String() {
+				t.Errorf("read back %+v, want %s from %s to %s", h, version, src, dst)
+			}
+
+			// Without a client, the header is LOCAL or UNKNOWN.
+			buf.Reset()
+			if err := WriteHeader(&buf, version, nil, dst); err != nil {
+				t.Fatal(err)
+			}
+			if h, err := ReadHeader(bufio.NewReader(&buf)); err != nil || h.Source != nil {
+				t.Errorf("read back %+v, %v, want no address", h, err)
+			}
+		})
+	}
+}
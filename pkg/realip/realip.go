@@ -0,0 +1,234 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers the client IP can be read from
+const (
+	HeaderXForwardedFor = "x-forwarded-for" // The default.
+	HeaderForwarded     = "forwarded"       // RFC 7239
+	HeaderXRealIP       = "x-real-ip"
+)
+
+// Resolver extracts the client IP of a request. The forwarding header is only honored when the
+// request comes from a trusted proxy, and is walked right to left, skipping trusted proxies,
+// so that addresses prepended by the client can't be used to spoof its IP. Only the header the
+// trusted proxies set is read: the others reach them from the client and pass through untouched.
+//
+// The peer address is the RemoteAddr of the request, which is the address from the PROXY
+// protocol header when the listener accepts it.
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string // header is the forwarding header set by the trusted proxies.
+}
+
+type contextKey struct{}
+
+// resolved is the result of the resolution stored in the request context.
+type resolved struct {
+	clientIP    string
+	trustedPeer bool
+	peerAddr    string
+}
+
+// Default trusts no proxy and resolves the client IP to the peer address.
+var Default = &Resolver{}
+
+// NewResolver creates a resolver trusting the given CIDRs or IP addresses, reading the client IP
+// from X-Forwarded-For.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{header: HeaderXForwardedFor}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+// UseHeader sets the forwarding header the client IP is read from, one of x-forwarded-for,
+// forwarded or x-real-ip.
+func (r *Resolver) UseHeader(header string) error {
+	switch header = strings.ToLower(header); header {
+	case "":
+		r.header = HeaderXForwardedFor
+	case HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP:
+		r.header = header
+	default:
+		return fmt.Errorf("unsupported client IP header %q", header)
+	}
+	return nil
+}
+
+// ClientIP returns the IP address of the client that sent the request.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := PeerIP(req.RemoteAddr)
+	if !r.IsTrusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	switch r.header {
+	case HeaderForwarded:
+		hops = forwarded(req.Header)
+	case HeaderXRealIP:
+		// X-Real-IP is set, not appended, by the trusted proxy.
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return peer
+	default:
+		hops = xForwardedFor(req.Header)
+	}
+	if len(hops) == 0 {
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// An unknown or obfuscated hop, the last trusted address is the best we know.
+			return client
+		}
+		client = ip.String()
+		if !r.IsTrusted(client) {
+			return client
+		}
+	}
+	return client
+}
+
+// IsTrusted reports whether ip belongs to a trusted proxy.
+func (r *Resolver) IsTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerIP returns the IP of a host:port address, IPv6 addresses included.
+func PeerIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+// WithClientIP resolves the client IP of the request and stores it in the request context.
+func (r *Resolver) WithClientIP(req *http.Request) *http.Request {
+	res := resolved{
+		clientIP:    r.ClientIP(req),
+		trustedPeer: r.IsTrusted(PeerIP(req.RemoteAddr)),
+		peerAddr:    req.RemoteAddr,
+	}
+	return req.WithContext(context.WithValue(req.Context(), contextKey{}, res))
+}
+
+// FromRequest returns the client IP resolved for the request, or the peer address when the
+// request wasn't resolved.
+func FromRequest(req *http.Request) string {
+	if res, ok := req.Context().Value(contextKey{}).(resolved); ok {
+		return res.clientIP
+	}
+	return Default.ClientIP(req)
+}
+
+// ClientAddr returns the address of the client stored in the context of a request. The port is
+// only known when the client is the peer of the connection, and is 0 otherwise.
+func ClientAddr(ctx context.Context) (*net.TCPAddr, bool) {
+	res, ok := ctx.Value(contextKey{}).(resolved)
+	if !ok {
+		return nil, false
+	}
+	ip := net.ParseIP(res.clientIP)
+	if ip == nil {
+		return nil, false
+	}
+
+	addr := &net.TCPAddr{IP: ip}
+	if host, port, err := net.SplitHostPort(res.peerAddr); err == nil && host == res.clientIP {
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return addr, true
+}
+
+// TrustedPeer reports whether the request was received from a trusted proxy, whose forwarding
+// headers can be passed on to the backends.
+func TrustedPeer(req *http.Request) bool {
+	res, ok := req.Context().Value(contextKey{}).(resolved)
+	return ok && res.trustedPeer
+}
+
+// forwarded returns the addresses of the RFC 7239 Forwarded header, left to right.
+func forwarded(h http.Header) []string {
+	var hops []string
+	for _, line := range h.Values("Forwarded") {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, parseForwardedNode(value))
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses of the X-Forwarded-For header, left to right.
+func xForwardedFor(h http.Header) []string {
+	var hops []string
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, PeerIP(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode returns the IP of a Forwarded node, e.g. "[2001:db8::1]:4711" or 192.0.2.60.
+func parseForwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
@@ -0,0 +1,45 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer", "", "203.0.113.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.1"},
+		{"xff", "", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"xff spoofed by the client", "", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"xff ignores forwarded", "", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1", "Forwarded": "for=1.2.3.4"}, "198.51.100.1"},
+		{"xff ignores x-real-ip", "", "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "10.0.0.1"},
+		{"forwarded", HeaderForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"forwarded ignores xff", HeaderForwarded, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1"},
+		{"x-real-ip", HeaderXRealIP, "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1", "X-Forwarded-For": "1.2.3.4"}, "198.51.100.1"},
+		{"ipv6 peer", "", "[2001:db8::2]:1234", nil, "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver([]string{"10.0.0.0/8"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.UseHeader(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := r.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
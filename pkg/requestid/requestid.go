@@ -0,0 +1,38 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header is the header carrying the request ID.
+const Header = "X-Request-Id"
+
+type contextKey struct{}
+
+// WithRequestID stores the request ID in the request context, using the ID sent by the client
+// or a new random one.
+func WithRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get(Header)
+	if id == "" {
+		id = New()
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, id))
+}
+
+// FromRequest returns the ID of the request, or the ID sent by the client when none was stored.
+func FromRequest(r *http.Request) string {
+	if id, ok := r.Context().Value(contextKey{}).(string); ok {
+		return id
+	}
+	return r.Header.Get(Header)
+}
+
+// New returns a random 128-bit request ID.
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// maxH2CUpgradeBody is the largest body of a request upgrading to h2c.
+const maxH2CUpgradeBody = 64 << 10
+
+// h2cUpgradeHandler switches HTTP/1.1 connections asking for "Upgrade: h2c" to cleartext HTTP/2
+// (RFC 7540 section 3.2), the upgrading request being served as the first stream. Connections
+// using prior knowledge are handled by the http.Server itself.
+type h2cUpgradeHandler struct {
+	handler http.Handler
+	h2s     *http2.Server
+}
+
+func (h *h2cUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 1 || !isH2CUpgrade(r.Header) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.Header.Get("HTTP2-Settings"), "="))
+	if err != nil {
+		// Ignoring the upgrade is always allowed.
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// The body of the upgrading request must be read before switching protocols, so it is held in
+	// memory up to a limit.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxH2CUpgradeBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	h.h2s.ServeConn(&bufferedConn{Conn: conn, reader: rw.Reader}, &http2.ServeConnOpts{
+		Context:        r.Context(),
+		Handler:        h.handler,
+		UpgradeRequest: r,
+		Settings:       settings,
+	})
+}
+
+func isH2CUpgrade(h http.Header) bool {
+	return headerContainsToken(h.Values("Upgrade"), "h2c") &&
+		headerContainsToken(h.Values("Connection"), "HTTP2-Settings") &&
+		len(h.Values("HTTP2-Settings")) == 1
+}
+
+func headerContainsToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedConn is a hijacked connection whose reads start with the data already buffered.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// protoHandler answers with the protocol of the request.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	fmt.Fprint(w, r.Proto)
+})
+
+const h2cUpgradeRequest = "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+	"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n"
+
+func TestH2CUpgrade(t *testing.T) {
+	srv := httptest.NewServer(&h2cUpgradeHandler{handler: protoHandler, h2s: &http2.Server{}})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, h2cUpgradeRequest+"\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// The upgrading request is answered as stream 1 of the HTTP/2 connection.
+	io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, br)
+	framer.WriteSettings()
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*http2.DataFrame); ok && data.StreamID == 1 {
+			if len(data.Data()) == 0 {
+				t.Error("empty response to the upgrading request")
+			}
+			return
+		}
+	}
+}
+
+func TestH2CUpgradeBodyLimit(t *testing.T) {
+	srv := httptest.NewServer(&h2cUpgradeHandler{handler: protoHandler, h2s: &http2.Server{}})
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"small body", 1024, http.StatusSwitchingProtocols},
+		{"large body", maxH2CUpgradeBody + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			request := strings.Replace(h2cUpgradeRequest, "GET", "POST", 1)
+			fmt.Fprintf(conn, "%sContent-Length: %d\r\n\r\n%s", request, tt.size, strings.Repeat("a", tt.size))
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	s := NewServer(context.Background(), zap.NewNop(), &config.VgoBalancer{H2C: true})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.newHTTPServer()
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s %d, want an HTTP/2 404 for an unknown service", resp.Proto, resp.StatusCode)
+	}
+}
+
+func TestIsH2CUpgrade(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"upgrade", http.Header{"Upgrade": {"h2c"}, "Connection": {"Upgrade, HTTP2-Settings"}, "Http2-Settings": {""}}, true},
+		{"case insensitive", http.Header{"Upgrade": {"H2C"}, "Connection": {"upgrade", "http2-settings"}, "Http2-Settings": {""}}, true},
+		{"websocket", http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}, false},
+		{"without settings", http.Header{"Upgrade": {"h2c"}, "Connection": {"Upgrade, HTTP2-Settings"}}, false},
+		{"settings not in connection", http.Header{"Upgrade": {"h2c"}, "Connection": {"Upgrade"}, "Http2-Settings": {""}}, false},
+		{"duplicate settings", http.Header{"Upgrade": {"h2c"}, "Connection": {"Upgrade, HTTP2-Settings"}, "Http2-Settings": {"", ""}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isH2CUpgrade(tt.header); got != tt.want {
+				t.Errorf("isH2CUpgrade = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
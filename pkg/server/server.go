@@ -2,15 +2,26 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"vgo-balancer/pkg/admin"
 	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/errorpage"
+	"vgo-balancer/pkg/proxyproto"
+	"vgo-balancer/pkg/realip"
+	"vgo-balancer/pkg/requestid"
 	"vgo-balancer/pkg/service"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
 )
 
 // default configurations
@@ -27,46 +38,273 @@ type Server struct {
 	logger *zap.Logger
 	config *config.VgoBalancer
 	ctx    context.Context
-}
+	realIP *realip.Resolver // realIP resolves the client IP from the trusted proxies.
+	errors *errorpage.Pages // errors render the errors of requests matching no service.
+
+	started  atomic.Bool // started is set once the listener accepts traffic.
+	draining atomic.Bool // draining is set when the shutdown starts.
 
-// Service Map stores the services registered with the load balancer.
-var serviceMap map[string]*service.Service
+	// services stores the services registered with the load balancer, published once all are
+	// registered and never modified afterwards.
+	services atomic.Pointer[map[string]*service.Service]
+}
 
 func NewServer(ctx context.Context, logger *zap.Logger, config *config.VgoBalancer) *Server {
 	server := &Server{
 		logger: logger,
 		config: config,
 		ctx:    ctx,
+		realIP: realip.Default,
+	}
+
+	resolver, err := realip.NewResolver(config.TrustedProxies)
+	if err == nil {
+		err = resolver.UseHeader(config.ClientIPHeader)
+	}
+	if err != nil {
+		logger.Error("Invalid trusted proxies, forwarding headers won't be trusted", zap.Error(err))
+	} else {
+		server.realIP = resolver
+	}
+
+	pages, err := errorpage.New(config.ErrorPages, "")
+	if err != nil {
+		logger.Error("Invalid error pages, using the default ones", zap.Error(err))
+	} else {
+		server.errors = pages
 	}
 	return server
 }
 
-func (s *Server) Start() {
+// Start registers the services and serves the load balancer until the context is done. It fails
+// if a service can't be registered or started, rather than running without it.
+func (s *Server) Start() error {
 	if s.config.Port == 0 {
 		s.config.Port = DefaultHTTPPort
 	}
 	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
 
+	// The services keep serving the traffic in progress during the shutdown, their context is only
+	// done once they are drained.
+	servicesCtx, stopServices := context.WithCancel(context.WithoutCancel(s.ctx))
+	defer stopServices()
+
 	s.logger.Info("Parsing configuration and registering services")
-	serviceMap = make(map[string]*service.Service)	
+	serviceMap := make(map[string]*service.Service)
 	for _, svc := range s.config.Services {
-		if _, ok := serviceMap[svc.Name]; !ok {
-			svcLogger := s.logger.With(zap.String("service", svc.Name))
-			service := service.NewService(&svc, s.ctx, svcLogger)
-			service.StartService()
-			serviceMap[svc.Name] = service
-			s.logger.Info(fmt.Sprintf("Service: %s, registered successfully.", svc.Name))
-		} else {
-			s.logger.Warn(fmt.Sprintf("Service: %s already exists. Please change the service name to avoid conflicts.", svc.Name))
+		if _, ok := serviceMap[svc.Name]; ok {
+			return fmt.Errorf("service %s is defined more than once", svc.Name)
+		}
+		svcLogger := s.logger.With(zap.String("service", svc.Name))
+		svc.ErrorPages = errorpage.Merge(s.config.ErrorPages, svc.ErrorPages)
+		service, err := service.NewService(&svc, servicesCtx, svcLogger)
+		if err != nil {
+			return fmt.Errorf("failed to register service %s: %w", svc.Name, err)
+		}
+		// Services with their own listener resolve the client IP like the load balancer.
+		service.RealIP = s.realIP
+		if err := service.StartService(); err != nil {
+			return fmt.Errorf("failed to start service %s: %w", svc.Name, err)
+		}
+		serviceMap[svc.Name] = service
+		s.logger.Info(fmt.Sprintf("Service: %s, registered successfully.", svc.Name))
+	}
+	s.services.Store(&serviceMap)
+
+	// The admin API outlives the shutdown, for readiness to report draining.
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	defer stopAdmin()
+	if s.config.Admin != nil {
+		adminHost := s.config.Admin.Host
+		if adminHost == "" {
+			adminHost = admin.DefaultHost
+		}
+		adminAddr := fmt.Sprintf("%s:%d", adminHost, s.config.Admin.Port)
+		go func() {
+			if err := admin.NewServer(s, s.config.Admin, s.logger.With(zap.String("component", "admin"))).ListenAndServe(adminCtx, adminAddr); err != nil {
+				s.logger.Error("Admin API stopped", zap.String("address", adminAddr), zap.Error(err))
+			}
+		}()
+	}
+
+	listener, err := s.listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	srv := s.newHTTPServer()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-s.ctx.Done()
+		s.shutdown(srv, stopServices)
+	}()
+
+	s.logger.Info("Starting Load Balancer", zap.String("address", addr), zap.Bool("tls", s.config.TLS != nil), zap.Bool("h2c", s.config.H2C))
+	s.started.Store(true)
+	if s.config.TLS != nil {
+		err = srv.ServeTLS(listener, s.config.TLS.CertFile, s.config.TLS.KeyFile)
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
+	return nil
+}
+
+// shutdown reports the balancer as not ready for the shutdown delay, so that it is taken out of
+// rotation, then stops accepting connections on every listener and waits for the requests,
+// connections and sessions in flight, before stopping the services.
+func (s *Server) shutdown(srv *http.Server, stopServices context.CancelFunc) {
+	defer stopServices()
+	s.draining.Store(true)
+	if s.config.ShutdownDelay > 0 {
+		s.logger.Info("Draining, waiting before closing the listener", zap.Duration("delay", s.config.ShutdownDelay))
+		time.Sleep(s.config.ShutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, svc := range s.Services() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := svc.Shutdown(ctx); err != nil {
+				s.logger.Error("Connections in flight interrupted by the shutdown", zap.String("service", svc.Name), zap.Error(err))
+			}
+		}()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		s.logger.Error("Requests in flight interrupted by the shutdown", zap.Error(err))
+		srv.Close()
+	}
+	wg.Wait()
+}
+
+// Started reports whether the listener accepts traffic.
+func (s *Server) Started() bool {
+	return s.started.Load()
+}
+
+// Draining reports whether the balancer is shutting down.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// newHTTPServer creates the server of the listener, speaking HTTP/1.1 and HTTP/2 over TLS, and
+// cleartext HTTP/2 when h2c is enabled.
+func (s *Server) newHTTPServer() *http.Server {
+	var handler http.Handler = http.HandlerFunc(s.handleRequest)
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	if s.config.H2C {
+		// Prior knowledge is handled by the server, upgrades by the handler.
+		protocols.SetUnencryptedHTTP2(true)
+		handler = &h2cUpgradeHandler{
+			handler: handler,
+			h2s:     &http2.Server{MaxConcurrentStreams: s.config.MaxStreams},
 		}
 	}
 
-	s.logger.Info("Starting Load Balancer", zap.String("address", addr))
-	http.ListenAndServe(addr, http.HandlerFunc(s.handleRequest))
+	return &http.Server{
+		Handler:   handler,
+		Protocols: protocols,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: int(s.config.MaxStreams),
+		},
+	}
+}
+
+// listen creates the listener of the load balancer, accepting PROXY protocol headers if enabled.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pp := s.config.ProxyProtocol
+	if pp == nil || !pp.Enabled {
+		return listener, nil
+	}
+
+	ppListener := &proxyproto.Listener{
+		Listener:      listener,
+		Required:      pp.Required,
+		HeaderTimeout: pp.HeaderTimeout,
+	}
+	if len(pp.TrustedSources) == 0 {
+		listener.Close()
+		return nil, errors.New("PROXY protocol requires trusted sources")
+	}
+	sources, err := realip.NewResolver(pp.TrustedSources)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("invalid PROXY protocol trusted sources: %w", err)
+	}
+	ppListener.Trusted = func(ip net.IP) bool { return sources.IsTrusted(ip.String()) }
+	s.logger.Info("PROXY protocol enabled on the listener", zap.Bool("required", pp.Required))
+	return ppListener, nil
+}
+
+// Services returns the registered services ordered by name.
+func (s *Server) Services() []*service.Service {
+	serviceMap := s.serviceMap()
+	services := make([]*service.Service, 0, len(serviceMap))
+	for _, svc := range serviceMap {
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// Service returns the registered service with the name.
+func (s *Server) Service(name string) (*service.Service, bool) {
+	svc, ok := s.serviceMap()[name]
+	return svc, ok
+}
+
+// serviceMap returns the registered services by name, nil until they are registered.
+func (s *Server) serviceMap() map[string]*service.Service {
+	if m := s.services.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// Reload applies the backends, weights and maintenance settings of a reloaded configuration to the
+// running services. Services using discovery keep the backends of their provider, and adding or
+// removing services requires a restart.
+func (s *Server) Reload(cfg *config.VgoBalancer) {
+	serviceMap := s.serviceMap()
+	if serviceMap == nil {
+		s.logger.Warn("Configuration reload ignored, the services aren't registered yet")
+		return
+	}
+	for _, svcCfg := range cfg.Services {
+		svc, ok := serviceMap[svcCfg.Name]
+		if !ok {
+			s.logger.Warn("New service ignored on reload, restart the load balancer to register it", zap.String("service", svcCfg.Name))
+			continue
+		}
+		if err := svc.ReloadMaintenance(svcCfg.Maintenance); err != nil {
+			s.logger.Error("Invalid maintenance configuration ignored on reload", zap.String("service", svcCfg.Name), zap.Error(err))
+		}
+		if svc.Disc != nil {
+			continue
+		}
+		svc.UpdateBackends(svcCfg.Backends)
+	}
+	s.logger.Info("Configuration reloaded")
 }
 
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	s.logger.Info("Received request", zap.String("method", r.Method), zap.String("url", r.URL.String()))
+	r = requestid.WithRequestID(s.realIP.WithClientIP(r))
+	s.logger.Info("Received request", zap.String("method", r.Method), zap.String("url", r.URL.String()), zap.String("client_ip", realip.FromRequest(r)), zap.String("request_id", requestid.FromRequest(r)))
 	svcName, err := s.GetServiceName(r)
 	if err != nil {
 		s.logger.Error("Failed to parse the request URL", zap.Error(err))
@@ -74,11 +312,12 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.logger.Info("Service name extracted from URL", zap.String("service", svcName))
-	if svc, ok := serviceMap[svcName]; ok {
+	// Services of other modes have their own listener.
+	if svc, ok := s.Service(svcName); ok && svc.Mode == service.ModeHTTP {
 		svc.ServeRequest(w, r)
 	} else {
 		s.logger.Error("service not found", zap.String("service", svcName))
-		http.Error(w, "Service not found", http.StatusNotFound)
+		s.errors.Write(w, r, errorpage.UnknownService)
 	}
 
 }
@@ -92,5 +331,3 @@ func (s *Server) GetServiceName(r *http.Request) (string, error) {
 	svcName := strings.Split(svcPath, "/")[0]
 	return svcName, nil // assuming the service name is the first part of the path
 }
-
-
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/service"
+
+	"go.uber.org/zap"
+)
+
+// freeAddr returns a localhost address nothing listens on.
+func freeAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// tcpEcho runs a backend echoing every connection, until the test ends.
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// roundTrip sends a message on a connection, and checks it comes back.
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != msg {
+		t.Errorf("reply = %q, want %q", reply, msg)
+	}
+}
+
+func TestShutdownDrainsServices(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	serviceAddr := freeAddr(t).String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer(ctx, zap.NewNop(), &config.VgoBalancer{
+		Host:          "127.0.0.1",
+		Port:          freeAddr(t).Port,
+		ShutdownDelay: delay,
+		Services: []config.Service{{
+			Name:     "db",
+			Mode:     service.ModeTCP,
+			Listen:   serviceAddr,
+			Backends: []config.Backend{{URL: "tcp://" + tcpEcho(t)}},
+		}},
+	})
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Start() }()
+
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.Started() || conn == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("load balancer not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+		conn, _ = net.Dial("tcp", serviceAddr)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "before")
+
+	// The service keeps accepting connections for the shutdown delay.
+	cancel()
+	time.Sleep(delay / 3)
+	if !s.Draining() {
+		t.Error("not draining after the shutdown started")
+	}
+	during, err := net.Dial("tcp", serviceAddr)
+	if err != nil {
+		t.Fatalf("connection refused during the shutdown delay: %v", err)
+	}
+	roundTrip(t, during, "during the delay")
+	during.Close()
+
+	// Then refuses new ones, and waits for those in progress.
+	time.Sleep(delay)
+	if c, err := net.Dial("tcp", serviceAddr); err == nil {
+		c.Close()
+		t.Error("connection accepted after the shutdown delay")
+	}
+	roundTrip(t, conn, "after the delay")
+	select {
+	case err := <-stopped:
+		t.Fatalf("load balancer stopped with %v, before the connections are drained", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Start error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("load balancer not stopped once drained")
+	}
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/requestid"
+
+	"go.uber.org/zap"
+)
+
+// ServeGRPC serves the gRPC calls received on the listen address of the service over cleartext
+// HTTP/2, until the service shuts down. It returns once the calls in progress are done.
+func (s *Service) ServeGRPC(listener net.Listener) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(s.serveGRPCCall),
+		Protocols: protocols,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-s.closing:
+			// The clients are sent a GOAWAY, and the calls in progress are cut when the context
+			// of the service is done.
+			if err := srv.Shutdown(s.Ctx); err != nil {
+				srv.Close()
+			}
+		case <-s.Ctx.Done():
+			srv.Close()
+		}
+	}()
+
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		s.Logger.Error("gRPC listener stopped", zap.Error(err))
+		return
+	}
+	<-stopped
+	s.Logger.Info("gRPC listener stopped", zap.String("address", listener.Addr().String()))
+}
+
+func (s *Service) serveGRPCCall(w http.ResponseWriter, r *http.Request) {
+	r = requestid.WithRequestID(s.RealIP.WithClientIP(r))
+	if !bc.IsGRPCRequest(r) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	// The deadline of the client bounds the call to the backend, which then fails with
+	// DEADLINE_EXCEEDED rather than UNAVAILABLE.
+	if timeout, ok := bc.GRPCTimeout(r); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	s.ServeRequest(w, r)
+}
+
+func init() {
+	RegisterHealthChecker(HealthCheckTypeGRPC, func(hc *config.HealthCheck) (HealthChecker, error) {
+		// gRPC runs over HTTP/2, with TLS for https backends and cleartext otherwise.
+		transport := newProbeTransport()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		return &grpcChecker{
+			service: hc.GRPCService,
+			target:  newCheckTarget(hc),
+			client:  &http.Client{Transport: transport},
+		}, nil
+	})
+}
+
+// grpcChecker calls the standard grpc.health.v1.Health/Check method of the backend.
+type grpcChecker struct {
+	service string
+	target  checkTarget
+	client  *http.Client
+}
+
+func (c *grpcChecker) Check(ctx context.Context, b *bc.Backend) error {
+	ctx = withProbeBackend(ctx, b)
+	healthURL := c.target.url(b)
+	healthURL.Path = grpcHealthCheckPath
+	healthURL.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "POST", healthURL.String(), bytes.NewReader(encodeHealthCheckRequest(c.service)))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Close = b.ProxyProtocol != ""
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	status, err := readHealthCheckResponse(resp)
+	if err != nil {
+		return err
+	}
+	if status != grpcHealthServing {
+		return fmt.Errorf("serving status %d", status)
+	}
+	return nil
+}
+
+// The grpc.health.v1 protocol, see https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcHealthServing   = 1 // HealthCheckResponse.ServingStatus SERVING
+	grpcMaxHealthFrame  = 1 << 16
+)
+
+// encodeHealthCheckRequest encodes a HealthCheckRequest{service} as a length-prefixed gRPC message.
+func encodeHealthCheckRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		// Field 1, length-delimited.
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readHealthCheckResponse reads the serving status of a HealthCheckResponse, failing when the
+// call ends with a gRPC status other than OK.
+func readHealthCheckResponse(resp *http.Response) (int, error) {
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, grpcMaxHealthFrame))
+	if err != nil {
+		return 0, err
+	}
+
+	// The status is in the trailers, or in the headers of a Trailers-Only response.
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	grpcMessage := resp.Trailer.Get("Grpc-Message")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+		grpcMessage = resp.Header.Get("Grpc-Message")
+	}
+	if grpcStatus != "0" {
+		if grpcStatus == "" {
+			return 0, errors.New("missing grpc-status")
+		}
+		return 0, fmt.Errorf("grpc-status %s: %s", grpcStatus, grpcMessage)
+	}
+
+	if len(body) < 5 {
+		return 0, errors.New("missing response message")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed response message")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint64(size) > uint64(len(body)-5) {
+		return 0, errors.New("truncated response message")
+	}
+	return decodeServingStatus(body[5 : 5+size])
+}
+
+// decodeServingStatus decodes the status field of a HealthCheckResponse, skipping unknown fields.
+func decodeServingStatus(msg []byte) (int, error) {
+	status := 0
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("invalid response message")
+		}
+		msg = msg[n:]
+
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("invalid response message")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				status = int(v)
+			}
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, errors.New("invalid response message")
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return 0, errors.New("invalid response message")
+			}
+			msg = msg[n+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, errors.New("invalid response message")
+			}
+			msg = msg[4:]
+		default:
+			return 0, errors.New("invalid response message")
+		}
+	}
+	return status, nil
+}
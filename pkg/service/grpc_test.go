@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/realip"
+	"vgo-balancer/pkg/requestid"
+
+	"go.uber.org/zap"
+)
+
+func TestGRPCCallClientIPAndRequestID(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:     "api",
+		Mode:     ModeGRPC,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: upstream.URL}},
+		Headers: config.Header{
+			RequestHeaderRules: []config.HeaderRule{
+				{Name: "X-Client-Ip", Value: "{{client_ip}}"},
+				{Name: "X-Call-Id", Value: "{{request_id}}"},
+			},
+		},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.RealIP, err = realip.NewResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		peer       string
+		headers    map[string]string
+		wantIP     string
+		wantCallID string
+	}{
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", requestid.Header: "abc"}, "198.51.100.7", "abc"},
+		{"untrusted peer", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://api/pkg.Service/Method", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set("Content-Type", "application/grpc")
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			svc.serveGRPCCall(w, r)
+
+			if got := w.Header().Get("Grpc-Status"); got != "0" {
+				t.Fatalf("grpc-status = %q, want 0", got)
+			}
+			h := <-received
+			if got := h.Get("X-Client-Ip"); got != tt.wantIP {
+				t.Errorf("client IP = %q, want %q", got, tt.wantIP)
+			}
+			// Calls without an ID get a new one.
+			got := h.Get("X-Call-Id")
+			if tt.wantCallID != "" && got != tt.wantCallID || got == "" {
+				t.Errorf("request ID = %q, want %q", got, tt.wantCallID)
+			}
+		})
+	}
+}
+
+func TestGRPCShutdownDrains(t *testing.T) {
+	called := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:     "api",
+		Mode:     ModeGRPC,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: upstream.URL}},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.serve(func() { svc.ServeGRPC(listener) })
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	result := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/pkg.Service/Method", strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(req)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		result <- resp.Header.Get("Grpc-Status") + resp.Trailer.Get("Grpc-Status")
+	}()
+	<-called
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	done := make(chan error, 1)
+	go func() { done <- svc.Shutdown(shutdownCtx) }()
+
+	// New connections are refused while the call in progress completes.
+	waitRefused(t, listener.Addr().String())
+	release <- struct{}{}
+	if got := <-result; got != "0" {
+		t.Errorf("call in progress ended with %q, want grpc-status 0", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown error = %v, want the calls drained", err)
+	}
+}
@@ -2,54 +2,145 @@ package service
 
 import (
 	"context"
-	"net"
-	"net/http"
+	"math/rand/v2"
+	"sort"
+	"sync"
 	"time"
-	"vgo-balancer/pkg/config"
 	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
 
 	"go.uber.org/zap"
 )
 
 const (
-	DefaultHealthCheckInterval = 30 * time.Second
-	DefaultHealthCheckTimeout  = 5 * time.Second
-	DefaultHealthCheckRetries  = 3
+	DefaultHealthCheckInterval          = 30 * time.Second
+	DefaultHealthCheckTimeout           = 5 * time.Second
+	DefaultHealthCheckRetries           = 3
+	DefaultHealthCheckUnhealthyInterval = 5 * time.Second
+	DefaultHealthyThreshold             = 2
 )
 
 // Supported health check types
 const (
 	HealthCheckTypeHTTP = "http"
 	HealthCheckTypeTCP  = "tcp"
+	HealthCheckTypeGRPC = "grpc"
+	HealthCheckTypeExec = "exec"
 )
 
 type HealthCheck struct {
-	endpoint        string        // The endpoint to check the health of the service.
-	interval        time.Duration // The interval to check the health of the service.
-	timeout         time.Duration // The timeout for the health check.
-	retries         int           // The number of retries, before marking the service as unhealthy.
-	healthCheckType string        // The type of health check. default is http.
-	client          *http.Client
-	logger          *zap.Logger
-	ctx             context.Context
+	interval           time.Duration // The interval to check the health of the service.
+	timeout            time.Duration // The timeout for the health check.
+	healthyThreshold   int           // The consecutive successes marking an unhealthy backend healthy.
+	unhealthyThreshold int           // The consecutive failures marking a healthy backend unhealthy.
+	unhealthyInterval  time.Duration // The interval of the checks of failing backends.
+	jitter             time.Duration // The maximum random delay added to the intervals.
+	maxBackoff         time.Duration // The maximum interval of the checks of unhealthy backends.
+	healthCheckType    string        // The type of health check. default is http.
+	checker            HealthChecker // checker probes the backends.
+	logger             *zap.Logger
+	ctx                context.Context
+
+	mu        sync.Mutex
+	probes    map[*bc.Backend]*probe // probes are the scheduled checks of the backends.
+	observers []HealthObserver
+}
+
+// probe is the scheduled check of a backend, and its results.
+type probe struct {
+	backend *bc.Backend
+	cancel  context.CancelFunc
+
+	mu           sync.Mutex
+	lastCheck    time.Time
+	lastDuration time.Duration
+	lastErr      error
+	nextCheck    time.Time
+	successes    int // consecutive successful checks.
+	failures     int // consecutive failed checks.
+}
+
+func (p *probe) status() BackendHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := BackendHealth{
+		Backend:              p.backend.URL.String(),
+		Healthy:              p.backend.IsAlive.Load(),
+		LastCheck:            p.lastCheck,
+		LastDuration:         p.lastDuration.String(),
+		NextCheck:            p.nextCheck,
+		ConsecutiveSuccesses: p.successes,
+		ConsecutiveFailures:  p.failures,
+	}
+	if p.lastErr != nil {
+		h.LastError = p.lastErr.Error()
+	}
+	return h
+}
+
+// BackendHealth is the health check status of a backend.
+type BackendHealth struct {
+	Backend              string       `json:"backend"`
+	Healthy              bool         `json:"healthy"`
+	LastCheck            time.Time    `json:"last_check"`
+	LastDuration         string       `json:"last_duration"`
+	LastError            string       `json:"last_error,omitempty"`
+	NextCheck            time.Time    `json:"next_check"`
+	ConsecutiveSuccesses int          `json:"consecutive_successes"`
+	ConsecutiveFailures  int          `json:"consecutive_failures"`
+	UDP                  *UDPCounters `json:"udp,omitempty"`
+}
+
+// HealthEvent is a transition of a backend between healthy and unhealthy.
+type HealthEvent struct {
+	Backend *bc.Backend
+	Healthy bool
+	Err     error // Err is the failure of the last check, for unhealthy backends.
+	Time    time.Time
+}
+
+// HealthObserver is notified of the health transitions of the backends, e.g. to alert or to
+// expose them. OnHealthChange is called from the health check goroutines and must not block.
+type HealthObserver interface {
+	OnHealthChange(event HealthEvent)
+}
+
+// HealthObserverFunc adapts a function to a HealthObserver.
+type HealthObserverFunc func(event HealthEvent)
+
+func (f HealthObserverFunc) OnHealthChange(event HealthEvent) {
+	f(event)
 }
 
-func NewHealthCheck(hc *config.HealthCheck, logger *zap.Logger, ctx context.Context) *HealthCheck {
+func NewHealthCheck(hc *config.HealthCheck, logger *zap.Logger, ctx context.Context) (*HealthCheck, error) {
+	if hc == nil {
+		hc = &config.HealthCheck{}
+	}
+
 	hcObj := &HealthCheck{
-		endpoint:        hc.Endpoint,
-		interval:        hc.Interval,
-		timeout:         hc.Timeout,
-		retries:         hc.Retries,
-		healthCheckType: hc.HealthCheckType,
-		logger:          logger,
-		ctx:             ctx,
+		interval:           hc.Interval,
+		timeout:            hc.Timeout,
+		healthyThreshold:   hc.HealthyThreshold,
+		unhealthyThreshold: hc.UnhealthyThreshold,
+		unhealthyInterval:  hc.UnhealthyInterval,
+		jitter:             hc.Jitter,
+		maxBackoff:         hc.MaxBackoff,
+		healthCheckType:    hc.HealthCheckType,
+		logger:             logger,
+		ctx:                ctx,
+		probes:             make(map[*bc.Backend]*probe),
 	}
 
-	if hcObj.endpoint == "" {
+	if hc.Endpoint == "" && (hcObj.healthCheckType == "" || hcObj.healthCheckType == HealthCheckTypeHTTP) {
 		logger.Warn("Health check endpoint is not provided. TCP based health check will be done.")
 		hcObj.healthCheckType = HealthCheckTypeTCP
 	}
 
+	if hcObj.healthCheckType == "" {
+		hcObj.healthCheckType = HealthCheckTypeHTTP
+	}
+
 	if hcObj.interval == 0 {
 		hcObj.interval = DefaultHealthCheckInterval
 	}
@@ -58,112 +149,196 @@ func NewHealthCheck(hc *config.HealthCheck, logger *zap.Logger, ctx context.Cont
 		hcObj.timeout = DefaultHealthCheckTimeout
 	}
 
-	if hcObj.retries == 0 {
-		hcObj.retries = DefaultHealthCheckRetries
+	// retries is the former name of the unhealthy threshold.
+	if hcObj.unhealthyThreshold == 0 {
+		hcObj.unhealthyThreshold = hc.Retries
+	}
+	if hcObj.unhealthyThreshold == 0 {
+		hcObj.unhealthyThreshold = DefaultHealthCheckRetries
 	}
 
-	if hcObj.healthCheckType == HealthCheckTypeHTTP {
-		hcObj.client = &http.Client{
-			Timeout: hcObj.timeout,
-		}
+	if hcObj.healthyThreshold == 0 {
+		hcObj.healthyThreshold = DefaultHealthyThreshold
 	}
 
-	return hcObj
+	if hcObj.unhealthyInterval == 0 {
+		hcObj.unhealthyInterval = min(DefaultHealthCheckUnhealthyInterval, hcObj.interval)
+	}
+
+	if hcObj.maxBackoff == 0 {
+		hcObj.maxBackoff = hcObj.interval
+	}
+
+	checker, err := newHealthChecker(hcObj.healthCheckType, hc)
+	if err != nil {
+		return nil, err
+	}
+	hcObj.checker = checker
+
+	return hcObj, nil
 }
 
+// StartHealthCheck schedules the checks of the backends that aren't checked yet.
 func (hc *HealthCheck) StartHealthCheck(backends []*bc.Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
 	for i, backend := range backends {
-		go func(b *bc.Backend, delay time.Duration) {
-			time.Sleep(delay)
-			for {
-				select {
-				case <-hc.ctx.Done():
-					hc.logger.Info("Health check stopped for the backend", zap.String("backend", b.URL.String()))
-					return
-				case <-time.After(hc.interval):
-					// Perform health check
-					if !hc.performHealthCheck(b) {
-						return
-					}
-				}
-			}
-		}(backend, time.Duration(i)*time.Second) // Stagger by 1 second for each backend
+		if _, ok := hc.probes[backend]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(hc.ctx)
+		p := &probe{backend: backend, cancel: cancel}
+		hc.probes[backend] = p
+		go hc.supervise(ctx, p, time.Duration(i)*time.Second) // Stagger by 1 second for each backend
 	}
 }
 
-func (hc *HealthCheck) performHealthCheck(b *bc.Backend) bool {
-	for i := 0; i < hc.retries; i++ {
-		switch hc.healthCheckType {
-		case HealthCheckTypeHTTP:
-			if hc.performHTTPHealthCheck(b) {
-				return true
-			}
-		case HealthCheckTypeTCP:
-			if hc.performTCPHealthCheck(b) {
-				return true
-			}
-		default:
-			hc.logger.Warn("Unsupported health check type", zap.String("type", hc.healthCheckType))
-			return false
+// StopHealthCheck stops the health check of backends removed from the pool.
+func (hc *HealthCheck) StopHealthCheck(backends []*bc.Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for _, backend := range backends {
+		if p, ok := hc.probes[backend]; ok {
+			p.cancel()
+			delete(hc.probes, backend)
 		}
-		time.Sleep(hc.interval)
 	}
-	hc.logger.Warn("Health check failed after retries", zap.String("backend", b.URL.String()))
-	return false
 }
 
-// http-based health check
-func (hc *HealthCheck) performHTTPHealthCheck(b *bc.Backend) bool {
-	healthURL := *b.URL
-	healthURL.Path = hc.endpoint
-	req, err := http.NewRequest("GET", healthURL.String(), nil)
-	if err != nil {
-		hc.logger.Warn("Failed to create HTTP health check request", zap.String("backend", b.URL.String()), zap.Error(err))
-		b.IsAlive.Store(false)
-		return false
+// Status returns the health of the checked backends, ordered by URL.
+func (hc *HealthCheck) Status() []BackendHealth {
+	hc.mu.Lock()
+	probes := make([]*probe, 0, len(hc.probes))
+	for _, p := range hc.probes {
+		probes = append(probes, p)
 	}
+	hc.mu.Unlock()
 
-	resp, err := hc.client.Do(req)
-	if err != nil {
-		hc.logger.Warn("HTTP health check failed for", zap.String("backend", b.URL.String()), zap.Error(err))
-		b.IsAlive.Store(false)
-		return false
+	status := make([]BackendHealth, 0, len(probes))
+	for _, p := range probes {
+		status = append(status, p.status())
 	}
-	defer resp.Body.Close()
+	sort.Slice(status, func(i, j int) bool { return status[i].Backend < status[j].Backend })
+	return status
+}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		b.IsAlive.Store(true)
-		return true
-	} else {
-		hc.logger.Warn("HTTP health check returned non-2xx", zap.String("backend", b.URL.String()), zap.Int("status", resp.StatusCode))
-		b.IsAlive.Store(false)
-		return false
+// supervise runs the checks of a backend until its context is done, restarting them if they panic.
+func (hc *HealthCheck) supervise(ctx context.Context, p *probe, delay time.Duration) {
+	for {
+		if !hc.run(ctx, p, delay) {
+			hc.logger.Info("Health check stopped for the backend", zap.String("backend", p.backend.URL.String()))
+			return
+		}
+		delay = hc.unhealthyInterval
 	}
 }
 
-// TCP-based health check.
-func (hc *HealthCheck) performTCPHealthCheck(b *bc.Backend) bool {
-	healthAddress := b.URL.Host
-	host, port, err := net.SplitHostPort(healthAddress)
-	if err != nil {
-		// If port is missing, infer from scheme
-		host = healthAddress
-		if b.URL.Scheme == "https" {
-			port = "443"
+// run checks the backend at its next interval until the context is done. It returns true when
+// the checks panicked and must be restarted.
+func (hc *HealthCheck) run(ctx context.Context, p *probe, delay time.Duration) (restart bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			hc.logger.Error("Health check panicked, restarting", zap.String("backend", p.backend.URL.String()), zap.Any("panic", r))
+			restart = true
+		}
+	}()
+
+	b := p.backend
+	for {
+		p.mu.Lock()
+		p.nextCheck = time.Now().Add(delay)
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+
+		start := time.Now()
+		err := hc.performHealthCheck(ctx, b)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		p.mu.Lock()
+		p.lastCheck, p.lastDuration, p.lastErr = start, time.Since(start), err
+		if err == nil {
+			p.successes, p.failures = p.successes+1, 0
 		} else {
-			port = "80"
+			p.successes, p.failures = 0, p.failures+1
 		}
+		successes, failures := p.successes, p.failures
+		p.mu.Unlock()
+
+		if err == nil {
+			if !b.IsAlive.Load() && successes >= hc.healthyThreshold {
+				hc.transition(b, true, nil)
+			}
+		} else {
+			hc.logger.Warn("Health check failed for", zap.String("backend", b.URL.String()), zap.String("type", hc.healthCheckType), zap.Int("failures", failures), zap.Error(err))
+			if b.IsAlive.Load() && failures >= hc.unhealthyThreshold {
+				hc.transition(b, false, err)
+			}
+		}
+		delay = hc.nextDelay(b.IsAlive.Load(), failures) + hc.jitterDelay()
 	}
+}
 
-	tcpAddress := net.JoinHostPort(host, port)
-	conn, err := net.DialTimeout("tcp", tcpAddress, hc.timeout)
-	if err != nil {
-		hc.logger.Warn("TCP health check failed for", zap.String("backend", b.URL.String()), zap.Error(err))
-		b.IsAlive.Store(false)
-		return false
+// nextDelay is the delay before the next check. Failing backends are probed at the unhealthy
+// interval to be confirmed dead sooner, and dead backends with an exponential backoff from the
+// unhealthy interval up to the max backoff.
+func (hc *HealthCheck) nextDelay(alive bool, failures int) time.Duration {
+	if failures == 0 {
+		return hc.interval
+	}
+	if alive {
+		return hc.unhealthyInterval
+	}
+	delay := hc.unhealthyInterval
+	for i := hc.unhealthyThreshold; i < failures && delay < hc.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, hc.maxBackoff)
+}
+
+// AddObserver registers an observer of the health transitions of the backends.
+func (hc *HealthCheck) AddObserver(o HealthObserver) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.observers = append(hc.observers, o)
+}
+
+// transition marks the backend healthy or unhealthy, and notifies the observers.
+func (hc *HealthCheck) transition(b *bc.Backend, healthy bool, err error) {
+	b.SetAlive(healthy)
+	if healthy {
+		hc.logger.Info("Backend is healthy", zap.String("backend", b.URL.String()))
+	} else {
+		hc.logger.Warn("Backend is unhealthy", zap.String("backend", b.URL.String()), zap.Error(err))
+	}
+
+	hc.mu.Lock()
+	observers := hc.observers
+	hc.mu.Unlock()
+	event := HealthEvent{Backend: b, Healthy: healthy, Err: err, Time: time.Now()}
+	for _, o := range observers {
+		o.OnHealthChange(event)
 	}
+}
+
+// jitterDelay is a random delay up to the jitter, spreading the probes of the backends.
+func (hc *HealthCheck) jitterDelay() time.Duration {
+	if hc.jitter <= 0 {
+		return 0
+	}
+	return rand.N(hc.jitter)
+}
 
-	conn.Close()
-	b.IsAlive.Store(true)
-	return true
+// performHealthCheck probes the backend once, returning why it is unhealthy or nil.
+func (hc *HealthCheck) performHealthCheck(ctx context.Context, b *bc.Backend) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+	return hc.checker.Check(ctx, b)
 }
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+)
+
+// maxExecOutput bounds the output of exec checks kept for the error.
+const maxExecOutput = 512
+
+func init() {
+	RegisterHealthChecker(HealthCheckTypeExec, func(hc *config.HealthCheck) (HealthChecker, error) {
+		if len(hc.Command) == 0 {
+			return nil, errors.New("command is required")
+		}
+		return &execChecker{command: hc.Command, target: newCheckTarget(hc)}, nil
+	})
+}
+
+// execChecker runs a local command with the address of the backend in its environment, the
+// backend being healthy when the command exits with 0. e.g. a script checking replication lag.
+type execChecker struct {
+	command []string
+	target  checkTarget
+}
+
+func (c *execChecker) Check(ctx context.Context, b *bc.Backend) error {
+	target := c.target.url(b)
+	host, port := c.target.hostPort(b)
+
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"VGO_BACKEND_URL="+target.String(),
+		"VGO_BACKEND_SCHEME="+target.Scheme,
+		"VGO_BACKEND_HOST="+host,
+		"VGO_BACKEND_PORT="+port,
+	)
+	// Don't wait for the children of a killed command holding the output open.
+	cmd.WaitDelay = time.Second
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("command timed out: %w", ctx.Err())
+	}
+	out := strings.TrimSpace(output.String())
+	if len(out) > maxExecOutput {
+		out = out[len(out)-maxExecOutput:]
+	}
+	if out == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, out)
+}
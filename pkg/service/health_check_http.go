@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+)
+
+// maxHealthCheckBody bounds the response body read by http checks asserting on it.
+const maxHealthCheckBody = 1 << 20
+
+// httpAssertions are the request and expectations of http health checks.
+type httpAssertions struct {
+	method       string
+	headers      map[string]string
+	body         string
+	host         string
+	status       []statusRange
+	bodyContains string
+	bodyRegex    *regexp.Regexp
+	json         map[string]string
+}
+
+// statusRange is an inclusive range of accepted status codes.
+type statusRange struct {
+	min, max int
+}
+
+func newHTTPAssertions(hc *config.HealthCheck) (*httpAssertions, error) {
+	a := &httpAssertions{
+		method:       strings.ToUpper(hc.Method),
+		headers:      hc.Headers,
+		body:         hc.Body,
+		host:         hc.Host,
+		bodyContains: hc.BodyContains,
+		json:         hc.JSON,
+	}
+	if a.method == "" {
+		a.method = http.MethodGet
+	}
+
+	for _, s := range hc.ExpectedStatus {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return nil, err
+		}
+		a.status = append(a.status, r)
+	}
+	if len(a.status) == 0 {
+		a.status = []statusRange{{200, 299}}
+	}
+
+	if hc.BodyRegex != "" {
+		re, err := regexp.Compile(hc.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body_regex: %w", err)
+		}
+		a.bodyRegex = re
+	}
+	return a, nil
+}
+
+// parseStatusRange parses a status code (200), class (2xx) or range (200-399).
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '5' {
+		class := int(s[0]-'0') * 100
+		return statusRange{class, class + 99}, nil
+	}
+	low, high, isRange := strings.Cut(s, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid health check expected status %q", s)
+	}
+	last := first
+	if isRange {
+		if last, err = strconv.Atoi(strings.TrimSpace(high)); err != nil || last < first {
+			return statusRange{}, fmt.Errorf("invalid health check expected status %q", s)
+		}
+	}
+	return statusRange{first, last}, nil
+}
+
+func (a *httpAssertions) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	var body io.Reader
+	if a.body != "" {
+		body = strings.NewReader(a.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, a.method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range a.headers {
+		req.Header.Set(name, value)
+	}
+	if a.host != "" {
+		req.Host = a.host
+	}
+	return req, nil
+}
+
+// check returns why the response doesn't meet the expectations, or nil.
+func (a *httpAssertions) check(resp *http.Response) error {
+	accepted := false
+	for _, r := range a.status {
+		if resp.StatusCode >= r.min && resp.StatusCode <= r.max {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if a.bodyContains == "" && a.bodyRegex == nil && len(a.json) == 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return fmt.Errorf("failed to read the body: %w", err)
+	}
+	if a.bodyContains != "" && !strings.Contains(string(body), a.bodyContains) {
+		return fmt.Errorf("body doesn't contain %q", a.bodyContains)
+	}
+	if a.bodyRegex != nil && !a.bodyRegex.Match(body) {
+		return fmt.Errorf("body doesn't match %q", a.bodyRegex.String())
+	}
+	if len(a.json) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("invalid JSON body: %w", err)
+		}
+		for path, expected := range a.json {
+			value, ok := lookupJSON(doc, path)
+			if !ok {
+				return fmt.Errorf("JSON path %q not found", path)
+			}
+			if actual := formatJSON(value); actual != expected {
+				return fmt.Errorf("JSON path %q is %q, expected %q", path, actual, expected)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupJSON resolves a dotted path in a JSON document, with array indexes as items.0 or
+// items[0]. A leading $ is accepted.
+func lookupJSON(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// formatJSON formats a JSON value for comparison with the expected string.
+func formatJSON(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return "null"
+	default:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+func init() {
+	RegisterHealthChecker(HealthCheckTypeHTTP, func(hc *config.HealthCheck) (HealthChecker, error) {
+		assertions, err := newHTTPAssertions(hc)
+		if err != nil {
+			return nil, err
+		}
+		return &httpChecker{
+			endpoint:   hc.Endpoint,
+			target:     newCheckTarget(hc),
+			assertions: assertions,
+			client:     &http.Client{Transport: newProbeTransport()},
+		}, nil
+	})
+}
+
+// httpChecker sends a request to the endpoint of the backend and checks the response.
+type httpChecker struct {
+	endpoint   string
+	target     checkTarget
+	assertions *httpAssertions
+	client     *http.Client
+}
+
+func (c *httpChecker) Check(ctx context.Context, b *bc.Backend) error {
+	ctx = withProbeBackend(ctx, b)
+	healthURL := c.target.url(b)
+	healthURL.Path, healthURL.RawQuery, _ = strings.Cut(c.endpoint, "?")
+	req, err := c.assertions.newRequest(ctx, healthURL.String())
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	// A PROXY protocol header describes a single connection, which can't be reused.
+	req.Close = b.ProxyProtocol != ""
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return c.assertions.check(resp)
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    statusRange
+		wantErr bool
+	}{
+		{"200", statusRange{200, 200}, false},
+		{"2xx", statusRange{200, 299}, false},
+		{"5XX", statusRange{500, 599}, false},
+		{"200-399", statusRange{200, 399}, false},
+		{" 204 - 206 ", statusRange{204, 206}, false},
+		{"6xx", statusRange{}, true},
+		{"399-200", statusRange{}, true},
+		{"ok", statusRange{}, true},
+		{"200-", statusRange{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseStatusRange(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseStatusRange(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPAssertions(t *testing.T) {
+	const doc = `{"status": "UP", "checks": [{"name": "db", "up": true}], "uptime": 12.5, "leader": null}`
+	tests := []struct {
+		name    string
+		hc      config.HealthCheck
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"default accepts 2xx", config.HealthCheck{}, 204, "", ""},
+		{"default rejects 3xx", config.HealthCheck{}, 301, "", "unexpected status 301"},
+		{"expected status", config.HealthCheck{ExpectedStatus: []string{"200", "401"}}, 401, "", ""},
+		{"expected range", config.HealthCheck{ExpectedStatus: []string{"200-399"}}, 404, "", "unexpected status 404"},
+		{"body contains", config.HealthCheck{BodyContains: "UP"}, 200, doc, ""},
+		{"body doesn't contain", config.HealthCheck{BodyContains: "DOWN"}, 200, doc, `doesn't contain "DOWN"`},
+		{"body regex", config.HealthCheck{BodyRegex: `"uptime": \d+`}, 200, doc, ""},
+		{"body regex mismatch", config.HealthCheck{BodyRegex: `^DOWN`}, 200, doc, "doesn't match"},
+		{"json", config.HealthCheck{JSON: map[string]string{"$.status": "UP", "checks[0].up": "true", "uptime": "12.5", "leader": "null"}}, 200, doc, ""},
+		{"json mismatch", config.HealthCheck{JSON: map[string]string{"checks.0.name": "cache"}}, 200, doc, `is "db", expected "cache"`},
+		{"json missing path", config.HealthCheck{JSON: map[string]string{"checks.1.name": "db"}}, 200, doc, "not found"},
+		{"json invalid body", config.HealthCheck{JSON: map[string]string{"status": "UP"}}, 200, "UP", "invalid JSON body"},
+		// The body isn't asserted on when the status is rejected.
+		{"status before body", config.HealthCheck{BodyContains: "UP"}, 500, doc, "unexpected status 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newHTTPAssertions(&tt.hc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = a.check(&http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPAssertionsInvalid(t *testing.T) {
+	for _, hc := range []config.HealthCheck{
+		{BodyRegex: "("},
+		{ExpectedStatus: []string{"2xx", "abc"}},
+	} {
+		if _, err := newHTTPAssertions(&hc); err == nil {
+			t.Errorf("newHTTPAssertions(%+v) succeeded, want an error", hc)
+		}
+	}
+}
+
+func TestHTTPCheckerRequest(t *testing.T) {
+	type request struct {
+		method, path, query, host, header, body string
+	}
+	received := make(chan request, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Method, r.URL.Path, r.URL.RawQuery, r.Host, r.Header.Get("Authorization"), string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	// The backend serves traffic on another port than the health check.
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	checkPort, _ := strconv.Atoi(port)
+	pool, err := bc.NewBEPool(&config.Service{
+		Name:     "web",
+		Backends: []config.Backend{{URL: "http://127.0.0.1:1"}},
+	}, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker, err := newHealthChecker(HealthCheckTypeHTTP, &config.HealthCheck{
+		Endpoint:       "/ready?deep=1",
+		Method:         "post",
+		Headers:        map[string]string{"Authorization": "Bearer probe"},
+		Body:           `{"ping": true}`,
+		Host:           "health.internal",
+		Port:           checkPort,
+		ExpectedStatus: []string{"202"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Check(context.Background(), pool.GetBackends()[0]); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	want := request{http.MethodPost, "/ready", "deep=1", "health.internal", "Bearer probe", `{"ping": true}`}
+	if got := <-received; got != want {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	backendURL, _ := url.Parse("http://10.0.0.1:8080/app")
+	b := &bc.Backend{URL: backendURL}
+	tests := []struct {
+		name     string
+		hc       config.HealthCheck
+		wantURL  string
+		wantHost string
+		wantPort string
+	}{
+		{"backend", config.HealthCheck{}, "http://10.0.0.1:8080/app", "10.0.0.1", "8080"},
+		{"port", config.HealthCheck{Port: 9090}, "http://10.0.0.1:9090/app", "10.0.0.1", "9090"},
+		{"scheme", config.HealthCheck{Scheme: "https", Port: 8443}, "https://10.0.0.1:8443/app", "10.0.0.1", "8443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newCheckTarget(&tt.hc)
+			u := target.url(b)
+			if got := u.String(); got != tt.wantURL {
+				t.Errorf("url = %s, want %s", got, tt.wantURL)
+			}
+			if host, port := target.hostPort(b); host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("hostPort = %s, %s, want %s, %s", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// scriptedChecker returns the scripted results in order, then blocks until the check is
+// cancelled, closing done.
+type scriptedChecker struct {
+	mu      sync.Mutex
+	results []error
+	calls   int
+	done    chan struct{}
+}
+
+func newScriptedChecker(results ...error) *scriptedChecker {
+	return &scriptedChecker{results: results, done: make(chan struct{})}
+}
+
+func (c *scriptedChecker) Check(ctx context.Context, b *bc.Backend) error {
+	c.mu.Lock()
+	if c.calls < len(c.results) {
+		err := c.results[c.calls]
+		c.calls++
+		c.mu.Unlock()
+		return err
+	}
+	if c.calls == len(c.results) {
+		close(c.done)
+		c.calls++
+	}
+	c.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// newTestHealthCheck creates a health check of the configuration probing with the checker, and a
+// backend to check, stopped when the test ends.
+func newTestHealthCheck(t *testing.T, cfg *config.HealthCheck, checker HealthChecker) (*HealthCheck, *bc.Backend) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cfg.HealthCheckType = HealthCheckTypeTCP
+	hc, err := NewHealthCheck(cfg, zap.NewNop(), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.checker = checker
+
+	pool, err := bc.NewBEPool(&config.Service{Name: "web", Backends: []config.Backend{{URL: "http://127.0.0.1:1"}}}, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hc, pool.GetBackends()[0]
+}
+
+// recordEvents records the health transitions of the health check.
+func recordEvents(hc *HealthCheck) func() []HealthEvent {
+	var mu sync.Mutex
+	var events []HealthEvent
+	hc.AddObserver(HealthObserverFunc(func(event HealthEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}))
+	return func() []HealthEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]HealthEvent(nil), events...)
+	}
+}
+
+func waitDone(t *testing.T, c *scriptedChecker) {
+	t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scripted checks not run")
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	down := errors.New("connection refused")
+	ok := error(nil)
+	tests := []struct {
+		name    string
+		results []error
+		want    []bool // want are the transitions, true for healthy.
+	}{
+		{"isolated failures", []error{down, down, ok, down, down, ok}, nil},
+		{"unhealthy threshold", []error{down, down, down}, []bool{false}},
+		// A single success of an unhealthy backend doesn't bring it back.
+		{"flapping", []error{down, down, down, ok, down, ok, down}, []bool{false}},
+		{"healthy threshold", []error{down, down, down, ok, ok}, []bool{false, true}},
+		{"recovered then failing", []error{down, down, down, ok, ok, down, down, down}, []bool{false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := newScriptedChecker(tt.results...)
+			hc, b := newTestHealthCheck(t, &config.HealthCheck{
+				Interval:           time.Millisecond,
+				UnhealthyInterval:  time.Millisecond,
+				UnhealthyThreshold: 3,
+				HealthyThreshold:   2,
+			}, checker)
+			events := recordEvents(hc)
+			hc.StartHealthCheck([]*bc.Backend{b})
+			waitDone(t, checker)
+
+			got := events()
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d transitions, want %v", len(got), tt.want)
+			}
+			for i, event := range got {
+				if event.Healthy != tt.want[i] || event.Backend != b {
+					t.Errorf("transition %d: healthy = %v, want %v", i, event.Healthy, tt.want[i])
+				}
+				if !event.Healthy && event.Err != down {
+					t.Errorf("transition %d: error = %v, want the last failure", i, event.Err)
+				}
+			}
+			if alive := b.IsAlive.Load(); len(tt.want) > 0 && alive != tt.want[len(tt.want)-1] {
+				t.Errorf("backend alive = %v after the transitions %v", alive, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckStatusCounters(t *testing.T) {
+	down := errors.New("connection refused")
+	checker := newScriptedChecker(nil, down, down)
+	hc, b := newTestHealthCheck(t, &config.HealthCheck{Interval: time.Millisecond, UnhealthyThreshold: 3}, checker)
+	hc.StartHealthCheck([]*bc.Backend{b})
+	waitDone(t, checker)
+
+	status := hc.Status()
+	if len(status) != 1 {
+		t.Fatalf("status of %d backends, want 1", len(status))
+	}
+	s := status[0]
+	if !s.Healthy || s.ConsecutiveFailures != 2 || s.ConsecutiveSuccesses != 0 || s.LastError != down.Error() || s.LastCheck.IsZero() {
+		t.Errorf("status = %+v, want healthy with 2 failures", s)
+	}
+}
+
+func TestHealthCheckFailingInterval(t *testing.T) {
+	hc := &HealthCheck{interval: 30 * time.Second, unhealthyInterval: 5 * time.Second, unhealthyThreshold: 3, maxBackoff: 30 * time.Second}
+	tests := []struct {
+		name     string
+		alive    bool
+		failures int
+		want     time.Duration
+	}{
+		{"healthy", true, 0, 30 * time.Second},
+		// Failing backends are confirmed dead sooner.
+		{"failing", true, 1, 5 * time.Second},
+		{"failing below the threshold", true, 2, 5 * time.Second},
+		{"recovering", false, 0, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hc.nextDelay(tt.alive, tt.failures); got != tt.want {
+				t.Errorf("nextDelay(%v, %d) = %s, want %s", tt.alive, tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckJitter(t *testing.T) {
+	hc := &HealthCheck{}
+	if d := hc.jitterDelay(); d != 0 {
+		t.Errorf("jitter without a configured jitter = %s, want 0", d)
+	}
+	hc.jitter = 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		if d := hc.jitterDelay(); d < 0 || d >= hc.jitter {
+			t.Fatalf("jitter = %s, want within [0, %s)", d, hc.jitter)
+		}
+	}
+}
+
+func TestNewHealthCheckDefaults(t *testing.T) {
+	type settings struct {
+		interval, unhealthyInterval          time.Duration
+		unhealthyThreshold, healthyThreshold int
+	}
+	tests := []struct {
+		name string
+		cfg  config.HealthCheck
+		want settings
+	}{
+		{"defaults", config.HealthCheck{}, settings{DefaultHealthCheckInterval, DefaultHealthCheckUnhealthyInterval, DefaultHealthCheckRetries, DefaultHealthyThreshold}},
+		{"retries", config.HealthCheck{Retries: 5}, settings{DefaultHealthCheckInterval, DefaultHealthCheckUnhealthyInterval, 5, DefaultHealthyThreshold}},
+		{"thresholds", config.HealthCheck{Retries: 5, UnhealthyThreshold: 2, HealthyThreshold: 4}, settings{DefaultHealthCheckInterval, DefaultHealthCheckUnhealthyInterval, 2, 4}},
+		// The unhealthy interval isn't longer than the interval.
+		{"short interval", config.HealthCheck{Interval: time.Second}, settings{time.Second, time.Second, DefaultHealthCheckRetries, DefaultHealthyThreshold}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc, err := NewHealthCheck(&tt.cfg, zap.NewNop(), context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := settings{hc.interval, hc.unhealthyInterval, hc.unhealthyThreshold, hc.healthyThreshold}
+			if got != tt.want {
+				t.Errorf("settings = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	hc := &HealthCheck{interval: 30 * time.Second, unhealthyInterval: 5 * time.Second, unhealthyThreshold: 3, maxBackoff: 30 * time.Second}
+	// Dead backends are probed from the unhealthy interval, doubling up to the max backoff.
+	want := []time.Duration{5, 10, 20, 30, 30, 30}
+	for i, w := range want {
+		failures := hc.unhealthyThreshold + i
+		if got := hc.nextDelay(false, failures); got != w*time.Second {
+			t.Errorf("nextDelay after %d failures = %s, want %s", failures, got, w*time.Second)
+		}
+	}
+}
+
+// panickingChecker panics on its first check, then succeeds.
+type panickingChecker struct {
+	calls atomic.Int32
+}
+
+func (c *panickingChecker) Check(ctx context.Context, b *bc.Backend) error {
+	if c.calls.Add(1) == 1 {
+		panic("checker bug")
+	}
+	return nil
+}
+
+func TestHealthCheckRestartsAfterPanic(t *testing.T) {
+	checker := &panickingChecker{}
+	hc, b := newTestHealthCheck(t, &config.HealthCheck{Interval: time.Millisecond, UnhealthyInterval: time.Millisecond}, checker)
+	hc.StartHealthCheck([]*bc.Backend{b})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for checker.calls.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("health check not restarted after a panic")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthCheckProbesDeadBackends(t *testing.T) {
+	down := errors.New("connection refused")
+	// The backend is dead after 3 failures, and keeps being probed until it recovers.
+	checker := newScriptedChecker(down, down, down, down, down, down, nil, nil)
+	hc, b := newTestHealthCheck(t, &config.HealthCheck{
+		Interval:           time.Millisecond,
+		UnhealthyInterval:  time.Millisecond,
+		MaxBackoff:         4 * time.Millisecond,
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+	}, checker)
+	events := recordEvents(hc)
+	hc.StartHealthCheck([]*bc.Backend{b})
+	waitDone(t, checker)
+
+	if got := events(); len(got) != 2 || got[0].Healthy || !got[1].Healthy {
+		t.Errorf("transitions = %+v, want unhealthy then healthy", got)
+	}
+	if !b.IsAlive.Load() {
+		t.Error("backend not back after recovering")
+	}
+}
+
+// countingChecker counts the checks of each backend.
+type countingChecker struct {
+	mu     sync.Mutex
+	counts map[*bc.Backend]int
+}
+
+func (c *countingChecker) Check(ctx context.Context, b *bc.Backend) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[b]++
+	return nil
+}
+
+func (c *countingChecker) count(b *bc.Backend) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[b]
+}
+
+func TestHealthCheckMembership(t *testing.T) {
+	checker := &countingChecker{counts: make(map[*bc.Backend]int)}
+	hc, b := newTestHealthCheck(t, &config.HealthCheck{Interval: time.Millisecond}, checker)
+	hc.StartHealthCheck([]*bc.Backend{b})
+	// Starting the checks of a backend already checked is a no-op.
+	hc.StartHealthCheck([]*bc.Backend{b})
+	if status := hc.Status(); len(status) != 1 {
+		t.Fatalf("status of %d backends, want 1", len(status))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for checker.count(b) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("backend not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A removed backend isn't checked nor reported anymore.
+	hc.StopHealthCheck([]*bc.Backend{b})
+	if status := hc.Status(); len(status) != 0 {
+		t.Errorf("status of %d backends after the removal, want 0", len(status))
+	}
+	time.Sleep(10 * time.Millisecond)
+	stopped := checker.count(b)
+	time.Sleep(20 * time.Millisecond)
+	if got := checker.count(b); got != stopped {
+		t.Errorf("%d checks after the removal", got-stopped)
+	}
+}
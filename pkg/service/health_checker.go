@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+)
+
+// HealthChecker probes a backend. Check returns why the backend is unhealthy, or nil, and must
+// return when the context, bounded by the health check timeout, is done.
+type HealthChecker interface {
+	Check(ctx context.Context, b *bc.Backend) error
+}
+
+// HealthCheckerFactory creates a health checker from the health check configuration of a service.
+type HealthCheckerFactory func(hc *config.HealthCheck) (HealthChecker, error)
+
+var (
+	checkersMu sync.RWMutex
+	checkers   = make(map[string]HealthCheckerFactory)
+)
+
+// RegisterHealthChecker makes a health check type available by name. It panics if the name is
+// already registered, and is meant to be called from the init function of the package
+// implementing the health checker.
+func RegisterHealthChecker(name string, factory HealthCheckerFactory) {
+	checkersMu.Lock()
+	defer checkersMu.Unlock()
+
+	if factory == nil {
+		panic("service: RegisterHealthChecker factory is nil")
+	}
+	if _, ok := checkers[name]; ok {
+		panic("service: RegisterHealthChecker called twice for health check type " + name)
+	}
+	checkers[name] = factory
+}
+
+// HealthCheckerNames returns the sorted names of the registered health check types.
+func HealthCheckerNames() []string {
+	checkersMu.RLock()
+	defer checkersMu.RUnlock()
+
+	names := make([]string, 0, len(checkers))
+	for name := range checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newHealthChecker(name string, hc *config.HealthCheck) (HealthChecker, error) {
+	checkersMu.RLock()
+	factory, ok := checkers[name]
+	checkersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown health check type %q, available types: %v", name, HealthCheckerNames())
+	}
+
+	checker, err := factory(hc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s health check: %w", name, err)
+	}
+	return checker, nil
+}
+
+// customHealthCheck reports whether the health check type isn't a network protocol of the
+// built-in service modes, e.g. exec or a registered health checker.
+func customHealthCheck(name string) bool {
+	switch name {
+	case "", HealthCheckTypeHTTP, HealthCheckTypeTCP, HealthCheckTypeGRPC:
+		return false
+	}
+	return true
+}
+
+func init() {
+	RegisterHealthChecker(HealthCheckTypeTCP, func(hc *config.HealthCheck) (HealthChecker, error) {
+		return &tcpChecker{target: newCheckTarget(hc)}, nil
+	})
+}
+
+// checkTarget is the address probed by the health checks, the backend address unless the port
+// or scheme are overridden.
+type checkTarget struct {
+	port   int
+	scheme string
+}
+
+func newCheckTarget(hc *config.HealthCheck) checkTarget {
+	return checkTarget{port: hc.Port, scheme: hc.Scheme}
+}
+
+// url is the URL of the backend with the health check port and scheme.
+func (t checkTarget) url(b *bc.Backend) url.URL {
+	target := *b.URL
+	if t.scheme != "" {
+		target.Scheme = t.scheme
+	}
+	if t.port != 0 {
+		target.Host = net.JoinHostPort(target.Hostname(), strconv.Itoa(t.port))
+	}
+	return target
+}
+
+// hostPort is the host and port of the backend, the port being inferred from the scheme when
+// missing.
+func (t checkTarget) hostPort(b *bc.Backend) (string, string) {
+	target := t.url(b)
+	if port := target.Port(); port != "" {
+		return target.Hostname(), port
+	}
+	if target.Scheme == "https" {
+		return target.Hostname(), "443"
+	}
+	return target.Hostname(), "80"
+}
+
+// tcpChecker checks that the backend accepts connections.
+type tcpChecker struct {
+	target checkTarget
+}
+
+func (c *tcpChecker) Check(ctx context.Context, b *bc.Backend) error {
+	host, port := c.target.hostPort(b)
+	conn, err := b.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type probeBackendKey struct{}
+
+// withProbeBackend returns the context of a probe to the backend, whose connections are opened by
+// probeDialContext.
+func withProbeBackend(ctx context.Context, b *bc.Backend) context.Context {
+	return context.WithValue(ctx, probeBackendKey{}, b)
+}
+
+// probeDialContext dials like the backend of the probe, so backends expecting a PROXY protocol
+// header get one.
+func probeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if b, ok := ctx.Value(probeBackendKey{}).(*bc.Backend); ok {
+		return b.DialContext(ctx, network, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// newProbeTransport returns the transport of the HTTP probes, dialing through probeDialContext.
+func newProbeTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = probeDialContext
+	return transport
+}
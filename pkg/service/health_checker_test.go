@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+func TestExecChecker(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	backendURL, _ := url.Parse("https://10.0.0.1:8443")
+	b := &bc.Backend{URL: backendURL}
+
+	tests := []struct {
+		name    string
+		hc      config.HealthCheck
+		timeout time.Duration
+		wantErr string
+	}{
+		{"exit 0", config.HealthCheck{Command: []string{"true"}}, time.Second, ""},
+		{"exit 1", config.HealthCheck{Command: []string{"false"}}, time.Second, "exit status 1"},
+		{"output in the error", config.HealthCheck{Command: []string{"sh", "-c", "echo lag too high; exit 2"}}, time.Second, "exit status 2: lag too high"},
+		{"environment", config.HealthCheck{Command: []string{"sh", "-c",
+			`[ "$VGO_BACKEND_URL" = https://10.0.0.1:8443 ] && [ "$VGO_BACKEND_SCHEME" = https ] && [ "$VGO_BACKEND_HOST" = 10.0.0.1 ] && [ "$VGO_BACKEND_PORT" = 8443 ]`,
+		}}, time.Second, ""},
+		{"port override", config.HealthCheck{Port: 9090, Command: []string{"sh", "-c", `[ "$VGO_BACKEND_PORT" = 9090 ]`}}, time.Second, ""},
+		{"timeout", config.HealthCheck{Command: []string{"sleep", "10"}}, 50 * time.Millisecond, "command timed out"},
+		{"missing command", config.HealthCheck{Command: []string{"vgo-missing-command"}}, time.Second, "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := newHealthChecker(HealthCheckTypeExec, &tt.hc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			err = checker.Check(ctx, b)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecCheckerRequiresCommand(t *testing.T) {
+	if _, err := newHealthChecker(HealthCheckTypeExec, &config.HealthCheck{}); err == nil || !strings.Contains(err.Error(), "command is required") {
+		t.Errorf("error = %v, want the command required", err)
+	}
+}
+
+func TestNewHealthCheckerUnknown(t *testing.T) {
+	_, err := newHealthChecker("nope", &config.HealthCheck{})
+	if err == nil {
+		t.Fatal("unknown health check type accepted")
+	}
+	for _, name := range []string{HealthCheckTypeExec, HealthCheckTypeGRPC, HealthCheckTypeHTTP, HealthCheckTypeTCP} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't list the %s type", err, name)
+		}
+	}
+}
+
+// staticChecker returns its error for every backend.
+type staticChecker struct {
+	err error
+}
+
+func (c staticChecker) Check(ctx context.Context, b *bc.Backend) error {
+	return c.err
+}
+
+func TestRegisterHealthChecker(t *testing.T) {
+	const name = "test-replication"
+	lagging := errors.New("replication lag")
+	RegisterHealthChecker(name, func(hc *config.HealthCheck) (HealthChecker, error) {
+		if hc.Endpoint == "" {
+			return nil, errors.New("endpoint is required")
+		}
+		return staticChecker{err: lagging}, nil
+	})
+	t.Cleanup(func() {
+		checkersMu.Lock()
+		delete(checkers, name)
+		checkersMu.Unlock()
+	})
+
+	// Registered types are used by the health checks, and their errors reported with the type.
+	hc, err := NewHealthCheck(&config.HealthCheck{HealthCheckType: name, Endpoint: "db"}, zap.NewNop(), context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.performHealthCheck(context.Background(), &bc.Backend{}); err != lagging {
+		t.Errorf("check error = %v, want %v", err, lagging)
+	}
+	if _, err := newHealthChecker(name, &config.HealthCheck{}); err == nil || !strings.Contains(err.Error(), "invalid "+name+" health check") {
+		t.Errorf("error = %v, want the invalid %s health check", err, name)
+	}
+	if !customHealthCheck(name) || customHealthCheck(HealthCheckTypeHTTP) {
+		t.Error("only the types other than the network protocols are custom")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		factory HealthCheckerFactory
+	}{
+		{"duplicate", func(*config.HealthCheck) (HealthChecker, error) { return nil, nil }},
+		{"nil factory", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("RegisterHealthChecker didn't panic")
+				}
+			}()
+			registered := name
+			if tt.factory == nil {
+				registered = "test-nil"
+			}
+			RegisterHealthChecker(registered, tt.factory)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/errorpage"
+	"vgo-balancer/pkg/realip"
+
+	"go.uber.org/zap"
+)
+
+// maintenance answers the requests of a service in maintenance without the backends, except for
+// allowed clients and requests with the bypass header.
+type maintenance struct {
+	enabled      atomic.Bool
+	configured   bool // configured is the enabled flag of the configuration.
+	retryAfter   time.Duration
+	allowed      *realip.Resolver // allowed matches the allowed client IPs, nil when none.
+	bypassHeader string
+	bypassValue  string
+}
+
+func newMaintenance(cfg *config.Maintenance) (*maintenance, error) {
+	m := &maintenance{}
+	if cfg == nil {
+		return m, nil
+	}
+	m.enabled.Store(cfg.Enabled)
+	m.configured = cfg.Enabled
+	m.retryAfter = cfg.RetryAfter
+	if len(cfg.AllowedIPs) > 0 {
+		allowed, err := realip.NewResolver(cfg.AllowedIPs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance allowed IPs: %w", err)
+		}
+		m.allowed = allowed
+	}
+	if cfg.BypassHeader != "" && cfg.BypassValue == "" {
+		return nil, errors.New("the maintenance bypass header requires a bypass value")
+	}
+	m.bypassHeader = http.CanonicalHeaderKey(cfg.BypassHeader)
+	m.bypassValue = cfg.BypassValue
+	return m, nil
+}
+
+// bypass reports whether the request, with the value of its bypass header, goes to the backends
+// despite the maintenance.
+func (m *maintenance) bypass(r *http.Request, value string) bool {
+	if m.bypassHeader != "" && subtle.ConstantTimeCompare([]byte(value), []byte(m.bypassValue)) == 1 {
+		return true
+	}
+	return m.allowed != nil && m.allowed.IsTrusted(realip.FromRequest(r))
+}
+
+// SetMaintenance puts the service in or out of maintenance.
+func (s *Service) SetMaintenance(enabled bool) {
+	if s.maintenance.Load().enabled.Swap(enabled) != enabled {
+		s.Logger.Info("Maintenance mode changed", zap.Bool("maintenance", enabled))
+	}
+}
+
+// ReloadMaintenance applies a reloaded maintenance configuration. The mode set through
+// SetMaintenance is kept unless the configured flag changed.
+func (s *Service) ReloadMaintenance(cfg *config.Maintenance) error {
+	m, err := newMaintenance(cfg)
+	if err != nil {
+		return err
+	}
+	current := s.maintenance.Load()
+	enabled := m.enabled.Load()
+	if m.configured == current.configured {
+		enabled = current.enabled.Load()
+	}
+	m.enabled.Store(enabled)
+	if s.maintenance.Swap(m).enabled.Load() != enabled {
+		s.Logger.Info("Maintenance mode changed", zap.Bool("maintenance", enabled))
+	}
+	return nil
+}
+
+// InMaintenance reports whether the service is in maintenance.
+func (s *Service) InMaintenance() bool {
+	return s.maintenance.Load().enabled.Load()
+}
+
+// serveMaintenance answers the request when the service is in maintenance and the request
+// doesn't bypass it. It returns false when the request must go to a backend.
+func (s *Service) serveMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	m := s.maintenance.Load()
+	var bypassValue string
+	if m.bypassHeader != "" {
+		// The header is removed in and out of maintenance, so that its secret never reaches the
+		// backends.
+		bypassValue = r.Header.Get(m.bypassHeader)
+		r.Header.Del(m.bypassHeader)
+	}
+	if !m.enabled.Load() || m.bypass(r, bypassValue) {
+		return false
+	}
+
+	if m.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter.Round(time.Second).Seconds())))
+	}
+	if s.Mode == ModeGRPC {
+		backend.WriteGRPCError(w, backend.GRPCStatusUnavailable, "service under maintenance")
+		return true
+	}
+	s.BEPool.ErrorPages.Write(w, r, errorpage.Maintenance)
+	return true
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+func TestMaintenance(t *testing.T) {
+	bypassSeen := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bypassSeen <- r.Header.Get("X-Maintenance-Bypass")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:     "web",
+		Backends: []config.Backend{{URL: upstream.URL}},
+		Maintenance: &config.Maintenance{
+			Enabled:      true,
+			RetryAfter:   10 * time.Minute,
+			AllowedIPs:   []string{"192.0.2.0/24"},
+			BypassHeader: "x-maintenance-bypass",
+			BypassValue:  "secret",
+		},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		peer   string
+		bypass string
+		want   int
+	}{
+		{"client", "198.51.100.1:1234", "", http.StatusServiceUnavailable},
+		{"allowed IP", "192.0.2.10:1234", "", http.StatusOK},
+		{"bypass header", "198.51.100.1:1234", "secret", http.StatusOK},
+		{"wrong bypass value", "198.51.100.1:1234", "guess", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.peer
+			if tt.bypass != "" {
+				r.Header.Set("X-Maintenance-Bypass", tt.bypass)
+			}
+			w := httptest.NewRecorder()
+			svc.ServeRequest(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusServiceUnavailable {
+				if got := w.Header().Get("Retry-After"); got != "600" {
+					t.Errorf("Retry-After = %q, want 600", got)
+				}
+				return
+			}
+			// The secret of the bypass header never reaches the backends.
+			if got := <-bypassSeen; got != "" {
+				t.Errorf("backend received the bypass header %q", got)
+			}
+		})
+	}
+
+	// Out of maintenance, every client reaches the backends.
+	svc.SetMaintenance(false)
+	w := httptest.NewRecorder()
+	svc.ServeRequest(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status out of maintenance = %d, want 200", w.Code)
+	}
+	<-bypassSeen
+}
+
+func TestMaintenanceGRPC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:        "api",
+		Mode:        ModeGRPC,
+		Listen:      "127.0.0.1:0",
+		Backends:    []config.Backend{{URL: "http://127.0.0.1:1"}},
+		Maintenance: &config.Maintenance{Enabled: true},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://api/pkg.Service/Method", nil)
+	r.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	svc.serveGRPCCall(w, r)
+	if got := w.Header().Get("Grpc-Status"); w.Code != http.StatusOK || got != "14" {
+		t.Errorf("status = %d, grpc-status = %q, want UNAVAILABLE", w.Code, got)
+	}
+}
+
+func TestReloadMaintenance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:     "web",
+		Backends: []config.Backend{{URL: "http://127.0.0.1:1"}},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		set     *bool
+		cfg     *config.Maintenance
+		want    bool
+		wantErr bool
+	}{
+		{name: "toggled at runtime", set: ptr(true), want: true},
+		// The runtime toggle is kept while the configured flag doesn't change.
+		{name: "reload without change", cfg: nil, want: true},
+		{name: "reload with a retry after", cfg: &config.Maintenance{RetryAfter: time.Minute}, want: true},
+		{name: "configured", cfg: &config.Maintenance{Enabled: true}, want: true},
+		{name: "configured off", cfg: &config.Maintenance{Enabled: false}, want: false},
+		{name: "invalid", cfg: &config.Maintenance{Enabled: true, BypassHeader: "X-Bypass"}, want: false, wantErr: true},
+		{name: "invalid allowed IPs", cfg: &config.Maintenance{Enabled: true, AllowedIPs: []string{"nope"}}, want: false, wantErr: true},
+	}
+	for _, step := range steps {
+		if step.set != nil {
+			svc.SetMaintenance(*step.set)
+		} else if err := svc.ReloadMaintenance(step.cfg); (err != nil) != step.wantErr {
+			t.Fatalf("%s: reload error = %v, want error %v", step.name, err, step.wantErr)
+		}
+		if got := svc.InMaintenance(); got != step.want {
+			t.Errorf("%s: in maintenance = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
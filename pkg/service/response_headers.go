@@ -0,0 +1,47 @@
+package service
+
+import (
+	"net/http"
+	"vgo-balancer/pkg/backend"
+)
+
+// responseHeadersWriter applies the response header rules of the service to the response sent to
+// the client, the rules being deferred by the proxy because the response may be stored or shared
+// first, or written by the balancer itself.
+type responseHeadersWriter struct {
+	http.ResponseWriter
+	headers       *backend.Header
+	req           *http.Request
+	headerWritten bool
+}
+
+func (hw *responseHeadersWriter) WriteHeader(status int) {
+	if hw.headerWritten {
+		return
+	}
+	// Informational responses, e.g. 103 Early Hints, don't get the rules of the final response,
+	// unless switching protocols.
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		hw.headerWritten = true
+		hw.headers.ApplyResponseHeaders(hw.Header(), hw.req, status)
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *responseHeadersWriter) Write(b []byte) (int, error) {
+	if !hw.headerWritten {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *responseHeadersWriter) Flush() {
+	if !hw.headerWritten {
+		hw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *responseHeadersWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
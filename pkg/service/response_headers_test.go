@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/requestid"
+
+	"go.uber.org/zap"
+)
+
+func TestCachedResponseHeaderRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc, err := NewService(&config.Service{
+		Name:     "web",
+		Backends: []config.Backend{{URL: upstream.URL}},
+		Cache:    &config.Cache{},
+		Headers: config.Header{
+			ResponseHeaderRules: []config.HeaderRule{
+				{Name: "X-Request-Echo", Value: "{{request_id}}"},
+				{Name: "X-Via", Value: "vgo", Action: backend.HeaderActionAppend},
+			},
+		},
+	}, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every client gets the rules rendered for its own request, stored or not.
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		r.Header.Set(requestid.Header, fmt.Sprintf("req-%d", i))
+		w := httptest.NewRecorder()
+		svc.ServeRequest(w, requestid.WithRequestID(r))
+
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %q, want %q", i, got, want)
+		}
+		if got := w.Header().Get("X-Request-Echo"); got != fmt.Sprintf("req-%d", i) {
+			t.Errorf("request %d: X-Request-Echo = %q", i, got)
+		}
+		if got := w.Header().Values("X-Via"); len(got) != 1 {
+			t.Errorf("request %d: X-Via = %q, want a single value", i, got)
+		}
+	}
+}
+
+func TestResponseHeaderRulesOnErrorPages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		backend string
+		setup   func(svc *Service)
+		status  int
+	}{
+		{"backend", upstream.URL, nil, http.StatusOK},
+		{"upstream connect", closed.URL, nil, http.StatusBadGateway},
+		{"no backend", upstream.URL, func(svc *Service) { svc.BEPool.GetBackends()[0].SetAlive(false) }, http.StatusServiceUnavailable},
+		{"maintenance", upstream.URL, func(svc *Service) { svc.SetMaintenance(true) }, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// Neither cache nor coalescing is enabled.
+			svc, err := NewService(&config.Service{
+				Name:     "web",
+				Backends: []config.Backend{{URL: tt.backend}},
+				Headers: config.Header{
+					ResponseHeaderRules: []config.HeaderRule{
+						{Name: "X-Request-Echo", Value: "{{request_id}}"},
+						{Name: "X-Via", Value: "vgo", Action: backend.HeaderActionAppend},
+						{Name: "X-Error", Value: "true", When: &config.HeaderCondition{StatusCodes: []int{502, 503}}},
+					},
+				},
+			}, ctx, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(svc)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+			r.Header.Set(requestid.Header, "req-1")
+			w := httptest.NewRecorder()
+			svc.ServeRequest(w, requestid.WithRequestID(r))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("X-Request-Echo"); got != "req-1" {
+				t.Errorf("X-Request-Echo = %q, want req-1", got)
+			}
+			if got := w.Header().Values("X-Via"); len(got) != 1 {
+				t.Errorf("X-Via = %q, want a single value", got)
+			}
+			if got, want := w.Header().Get("X-Error") != "", tt.status != http.StatusOK; got != want {
+				t.Errorf("X-Error set = %v, want %v for a %d", got, want, tt.status)
+			}
+		})
+	}
+}
+
+func TestResponseHeadersWriterStatuses(t *testing.T) {
+	headers, err := backend.NewHeaders(config.Header{ResponseHeaderRules: []config.HeaderRule{{Name: "X-Via", Value: "vgo", Action: backend.HeaderActionAppend}}}, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r = r.WithContext(backend.DeferResponseHeaders(r.Context()))
+
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		// The rules apply to the final response only.
+		{"early hints", []int{http.StatusEarlyHints, http.StatusOK}, 1},
+		{"switching protocols", []int{http.StatusSwitchingProtocols}, 1},
+		{"once", []int{http.StatusOK, http.StatusOK}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			hw := &responseHeadersWriter{ResponseWriter: w, headers: headers, req: r}
+			for _, status := range tt.statuses {
+				hw.WriteHeader(status)
+			}
+			if got := w.Header().Values("X-Via"); len(got) != tt.want {
+				t.Errorf("X-Via = %q, want %d values", got, tt.want)
+			}
+		})
+	}
+}
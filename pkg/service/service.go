@@ -2,24 +2,57 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 	"vgo-balancer/pkg/algo"
 	"vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/cache"
 	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/discovery"
+	"vgo-balancer/pkg/errorpage"
+	"vgo-balancer/pkg/realip"
 
 	"go.uber.org/zap"
 )
 
+// Supported service modes
+const (
+	ModeHTTP = "http"
+	ModeTCP  = "tcp"
+	ModeUDP  = "udp"
+	// ModeGRPC balances gRPC calls, each call of a client connection going to the backend
+	// selected by the algorithm.
+	ModeGRPC = "grpc"
+)
+
 type Service struct {
 	Name   string          // Unique name of the service.
 	Host   string          // Host address where the service is accessible.
 	Port   int             // Port number on which the service listens.
 	BEPool *backend.BEPool // Backend Pool
 	Algo   algo.Algorithm
-	Hc     *HealthCheck // HealthCheck is the health check configuration.
+	Hc     *HealthCheck       // HealthCheck is the health check configuration, nil when disabled.
+	Disc   discovery.Provider // Disc discovers the backends of the service, if configured.
+	Mode   string             // Mode is the type of traffic balanced. e.g. http, tcp, udp
+	Listen string             // Listen is the address of the dedicated listener of tcp and udp services.
+	Cache  *cache.Cache       // Cache stores the cacheable responses of http services, nil when disabled.
+	Coal   *cache.Coalescer   // Coal collapses identical concurrent requests of http services, nil when disabled.
 	Ctx    context.Context
-	Logger *zap.Logger // Logger is used to log information and errors.
+	Logger *zap.Logger      // Logger is used to log information and errors.
+	RealIP *realip.Resolver // RealIP resolves the client IP of the calls received on the listener of grpc services.
+
+	idleTimeout    time.Duration               // idleTimeout closes tcp connections without traffic.
+	connectTimeout time.Duration               // connectTimeout is the timeout to connect to tcp backends.
+	sessionTimeout time.Duration               // sessionTimeout ends udp sessions without traffic.
+	maintenance    atomic.Pointer[maintenance] // maintenance answers requests without the backends when enabled.
+	udp            udpProxy
+	closing        chan struct{}  // closing is closed when the service shuts down, to stop accepting traffic.
+	closeOnce      sync.Once      // closeOnce closes closing.
+	listeners      sync.WaitGroup // listeners are the dedicated listeners serving, until drained.
 }
 
 type Header struct {
@@ -29,34 +62,301 @@ type Header struct {
 	RemoveResponseHeaders []string          // RemoveResponseHeaders is a list of headers to be removed from the response.
 }
 
-func NewService(svc *config.Service, ctx context.Context, logger *zap.Logger) *Service {
-	bePool := backend.NewBEPool(svc.Backends, svc.RequestTimeout, svc.Headers, logger)
-	hc := NewHealthCheck(svc.HealthCheck, logger, ctx)
-	return &Service{
-		Name:   svc.Name,
-		BEPool: bePool,
-		Algo:   algo.CreateAlgorithm(svc.LBtype, bePool.Backends), // Initialize the Algo field
-		Hc:     hc,
-		Ctx:    ctx,
-		Logger: logger,
+func NewService(svc *config.Service, ctx context.Context, logger *zap.Logger) (*Service, error) {
+	mode := svc.Mode
+	if mode == "" {
+		mode = ModeHTTP
+	}
+	bePool, err := backend.NewBEPool(svc, mode == ModeGRPC, logger)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMaintenance(svc.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+	lb, err := algo.CreateAlgorithm(svc.LBtype, bePool.GetBackends(), svc.LBOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		Name:           svc.Name,
+		BEPool:         bePool,
+		Algo:           lb,
+		Mode:           mode,
+		Listen:         svc.Listen,
+		Ctx:            ctx,
+		Logger:         logger,
+		RealIP:         realip.Default,
+		idleTimeout:    svc.IdleTimeout,
+		connectTimeout: svc.RequestTimeout,
+		sessionTimeout: svc.SessionTimeout,
+		closing:        make(chan struct{}),
+	}
+	s.maintenance.Store(m)
+
+	hcConfig := svc.HealthCheck
+	if svc.Cache != nil && s.Mode != ModeHTTP {
+		return nil, fmt.Errorf("%s services don't support caching", s.Mode)
+	}
+	if svc.Coalesce != nil && s.Mode != ModeHTTP {
+		return nil, fmt.Errorf("%s services don't support request coalescing", s.Mode)
+	}
+	switch s.Mode {
+	case ModeHTTP:
+		if svc.Cache != nil {
+			if s.Cache, err = cache.New(svc.Cache); err != nil {
+				return nil, fmt.Errorf("failed to create the cache: %w", err)
+			}
+		}
+		if svc.Coalesce != nil {
+			s.Coal = cache.NewCoalescer(svc.Coalesce, backend.FromBackend, svc.RequestTimeout)
+		}
+	case ModeGRPC:
+		if s.Listen == "" {
+			return nil, fmt.Errorf("%s services require a listen address", s.Mode)
+		}
+		// Backends are checked with the gRPC health checking protocol unless configured otherwise.
+		hcConfig = &config.HealthCheck{}
+		if svc.HealthCheck != nil {
+			*hcConfig = *svc.HealthCheck
+		}
+		if hcConfig.HealthCheckType == "" {
+			hcConfig.HealthCheckType = HealthCheckTypeGRPC
+		}
+	case ModeTCP:
+		if s.Listen == "" {
+			return nil, fmt.Errorf("%s services require a listen address", s.Mode)
+		}
+		if s.idleTimeout == 0 {
+			s.idleTimeout = DefaultTCPIdleTimeout
+		}
+		if s.connectTimeout == 0 {
+			s.connectTimeout = DefaultTCPConnectTimeout
+		}
+		// Raw TCP backends are checked by connecting to them, unless a command or a custom
+		// health checker knows better.
+		hcConfig = &config.HealthCheck{}
+		if svc.HealthCheck != nil {
+			*hcConfig = *svc.HealthCheck
+		}
+		if !customHealthCheck(hcConfig.HealthCheckType) {
+			hcConfig.Endpoint = ""
+			hcConfig.HealthCheckType = HealthCheckTypeTCP
+		}
+	case ModeUDP:
+		if s.Listen == "" {
+			return nil, fmt.Errorf("%s services require a listen address", s.Mode)
+		}
+		if s.sessionTimeout == 0 {
+			s.sessionTimeout = DefaultUDPSessionTimeout
+		}
+		s.udp.sessions = make(map[string]*udpSession)
+		s.udp.pending = make(map[string][][]byte)
+		s.udp.drained = make(chan struct{})
+		// UDP can't be probed generically, backends are only checked over TCP when configured,
+		// e.g. for DNS servers also listening on TCP.
+		if svc.HealthCheck != nil {
+			hcConfig = &config.HealthCheck{}
+			*hcConfig = *svc.HealthCheck
+			if !customHealthCheck(hcConfig.HealthCheckType) {
+				hcConfig.Endpoint = ""
+				hcConfig.HealthCheckType = HealthCheckTypeTCP
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported service mode %q", s.Mode)
+	}
+	if hcConfig != nil || s.Mode != ModeUDP {
+		hc, err := NewHealthCheck(hcConfig, logger, ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.Hc = hc
+	}
+
+	if svc.Discovery != nil {
+		provider, err := discovery.CreateProvider(svc.Discovery, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the discovery provider: %w", err)
+		}
+		s.Disc = provider
+	}
+	return s, nil
+}
+
+func (s *Service) StartService() error {
+	if s.Mode == ModeTCP {
+		listener, err := net.Listen("tcp", s.Listen)
+		if err != nil {
+			return err
+		}
+		s.Logger.Info("Starting TCP listener", zap.String("address", s.Listen))
+		s.serve(func() { s.ServeTCP(listener) })
+	}
+	if s.Mode == ModeGRPC {
+		listener, err := net.Listen("tcp", s.Listen)
+		if err != nil {
+			return err
+		}
+		s.Logger.Info("Starting gRPC listener", zap.String("address", s.Listen))
+		s.serve(func() { s.ServeGRPC(listener) })
+	}
+	if s.Mode == ModeUDP {
+		addr, err := net.ResolveUDPAddr("udp", s.Listen)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		s.Logger.Info("Starting UDP listener", zap.String("address", s.Listen))
+		s.serve(func() { s.ServeUDP(conn) })
+	}
+
+	if s.Hc != nil {
+		s.Hc.StartHealthCheck(s.BEPool.GetBackends())
+	}
+	if s.Disc != nil {
+		go func() {
+			if err := s.Disc.Watch(s.Ctx, s.UpdateBackends); err != nil {
+				s.Logger.Error("Backend discovery stopped", zap.String("provider", s.Disc.Name()), zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+// UpdateBackends replaces the backends of the service, starting the health check of the new
+// backends and stopping it for the removed ones.
+// serve runs the dedicated listener of the service until it is drained.
+func (s *Service) serve(listen func()) {
+	s.listeners.Add(1)
+	go func() {
+		defer s.listeners.Done()
+		listen()
+	}()
+}
+
+// Shutdown stops accepting new connections, calls and sessions on the dedicated listener of the
+// service, and waits for the ones in progress until the context is done. Those left are closed
+// when the context of the service is done.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	drained := make(chan struct{})
+	go func() {
+		s.listeners.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (s *Service) StartService() {
-	s.Hc.StartHealthCheck(s.BEPool.Backends)
+func (s *Service) UpdateBackends(backends []config.Backend) {
+	added, removed := s.BEPool.Update(backends)
+	if s.Hc != nil {
+		s.Hc.StartHealthCheck(added)
+		s.Hc.StopHealthCheck(removed)
+	}
+	for _, b := range removed {
+		b.Close()
+		s.udp.stats.Delete(b)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		s.Logger.Info("Backend pool updated", zap.Int("added", len(added)), zap.Int("removed", len(removed)), zap.Int("total", len(s.BEPool.GetBackends())))
+	}
+}
+
+// HealthStatus returns the health of the backends of the service, with their traffic for udp
+// services. Without health check, only whether backends are alive is known.
+func (s *Service) HealthStatus() []BackendHealth {
+	backends := s.BEPool.GetBackends()
+	var status []BackendHealth
+	if s.Hc != nil {
+		status = s.Hc.Status()
+	} else {
+		status = make([]BackendHealth, 0, len(backends))
+		for _, b := range backends {
+			status = append(status, BackendHealth{Backend: b.URL.String(), Healthy: b.IsAlive.Load()})
+		}
+	}
+
+	if s.Mode == ModeUDP {
+		counters := make(map[string]UDPCounters, len(backends))
+		for _, b := range backends {
+			counters[b.URL.String()] = s.udpCounters(b)
+		}
+		for i := range status {
+			if c, ok := counters[status[i].Backend]; ok {
+				status[i].UDP = &c
+			}
+		}
+	}
+	return status
+}
+
+// HealthyBackends returns the number of healthy backends and the size of the pool.
+func (s *Service) HealthyBackends() (healthy, total int) {
+	backends := s.BEPool.GetBackends()
+	for _, b := range backends {
+		if b.IsAlive.Load() {
+			healthy++
+		}
+	}
+	return healthy, len(backends)
 }
 
 func (s *Service) ServeRequest(w http.ResponseWriter, r *http.Request) {
+	// The response header rules are applied as the response reaches the client, whether a backend,
+	// the cache or the balancer itself answers, e.g. with an error page. The responses of the
+	// backends are stored and shared as sent, the rules being rendered for every client.
+	r = r.WithContext(backend.DeferResponseHeaders(r.Context()))
+	w = &responseHeadersWriter{ResponseWriter: w, headers: s.BEPool.Headers, req: r}
+	if s.serveMaintenance(w, r) {
+		return
+	}
+	if s.Cache != nil {
+		s.Cache.ServeHTTP(w, r, s.serveUpstream)
+		return
+	}
+	s.serveUpstream(w, r)
+}
+
+// serveUpstream sends the request to the backends, collapsed with identical requests in flight
+// when coalescing is enabled.
+func (s *Service) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	if s.Coal != nil {
+		s.Coal.ServeHTTP(w, r, s.serveBackend)
+		return
+	}
+	s.serveBackend(w, r)
+}
+
+// serveBackend proxies the request to the backend selected by the load balancing algorithm.
+func (s *Service) serveBackend(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	currentBE := s.Algo.NextBackend(s.BEPool.Backends, w, r)
+	currentBE := s.Algo.NextBackend(s.BEPool.GetBackends(), w, r)
 	if currentBE == nil {
 		s.Logger.Error("Failed to select backend, No available backend found.")
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		if s.Mode == ModeGRPC {
+			backend.WriteGRPCError(w, backend.GRPCStatusUnavailable, "no backend available")
+			return
+		}
+		s.BEPool.ErrorPages.Write(w, r, errorpage.NoBackend)
 		return
 	}
 	s.Logger.Info("Selected backend", zap.String("backend", currentBE.URL.String()))
+	currentBE.Inflight.Add(1)
+	defer currentBE.Inflight.Add(-1)
 	currentBE.Proxy.ServeHTTP(w, r)
 	duration := time.Since(start)
-	currentBE.ResponseTime = duration
+	currentBE.Latency.Observe(duration)
 	s.Logger.Info("Request served", zap.String("backend", currentBE.URL.String()))
 }
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/proxyproto"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTCPIdleTimeout    = 5 * time.Minute
+	DefaultTCPConnectTimeout = 5 * time.Second
+	tcpBufferSize            = 32 * 1024
+)
+
+// ServeTCP accepts raw connections on the listen address of the service and splices each one
+// to a backend selected by the algorithm, until the service shuts down. It returns once the
+// connections in progress are done.
+func (s *Service) ServeTCP(listener net.Listener) {
+	go func() {
+		select {
+		case <-s.closing:
+		case <-s.Ctx.Done():
+		}
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || s.Ctx.Err() != nil {
+				s.Logger.Info("TCP listener stopped", zap.String("address", listener.Addr().String()))
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			s.Logger.Error("Failed to accept TCP connection", zap.Error(err))
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleTCPConn(conn)
+		}()
+	}
+}
+
+func (s *Service) handleTCPConn(client net.Conn) {
+	defer client.Close()
+
+	be, upstream := s.dialTCPBackend(client)
+	if upstream == nil {
+		s.Logger.Error("Failed to select backend, No available backend found.", zap.String("client", client.RemoteAddr().String()))
+		return
+	}
+	defer upstream.Close()
+	// The connections still open when the service context is done are cut.
+	stop := context.AfterFunc(s.Ctx, func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	be.Inflight.Add(1)
+	defer be.Inflight.Add(-1)
+
+	s.Logger.Info("TCP connection opened", zap.String("client", client.RemoteAddr().String()), zap.String("backend", be.URL.String()))
+	start := time.Now()
+	sent, received := splice(client, upstream, s.idleTimeout)
+	s.Logger.Info("TCP connection closed", zap.String("client", client.RemoteAddr().String()), zap.String("backend", be.URL.String()),
+		zap.Int64("bytes_sent", sent), zap.Int64("bytes_received", received), zap.Duration("duration", time.Since(start)))
+}
+
+// dialTCPBackend connects to a backend selected by the algorithm, trying the next one when the
+// connection fails. Algorithms are given no request, request-aware ones fall back on their own.
+func (s *Service) dialTCPBackend(client net.Conn) (*bc.Backend, net.Conn) {
+	candidates := s.BEPool.GetBackends()
+	for len(candidates) > 0 {
+		be := s.Algo.NextBackend(candidates, nil, nil)
+		if be == nil {
+			return nil, nil
+		}
+
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", be.URL.Host, s.connectTimeout)
+		if err != nil {
+			s.Logger.Warn("Failed to connect to the backend", zap.String("backend", be.URL.String()), zap.Error(err))
+			candidates = without(candidates, be)
+			continue
+		}
+		be.Latency.Observe(time.Since(start))
+
+		if be.ProxyProtocol != "" {
+			if err := proxyproto.WriteHeader(conn, be.ProxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+				s.Logger.Warn("Failed to send the PROXY protocol header", zap.String("backend", be.URL.String()), zap.Error(err))
+				conn.Close()
+				candidates = without(candidates, be)
+				continue
+			}
+		}
+		return be, conn
+	}
+	return nil, nil
+}
+
+// without returns a copy of pool without b.
+func without(pool []*bc.Backend, b *bc.Backend) []*bc.Backend {
+	rest := make([]*bc.Backend, 0, len(pool))
+	for _, p := range pool {
+		if p != b {
+			rest = append(rest, p)
+		}
+	}
+	return rest
+}
+
+// splice copies bytes in both directions until both sides are done, or until no byte went
+// through in either direction for the idle timeout.
+func splice(client, upstream net.Conn, idleTimeout time.Duration) (sent, received int64) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	done := make(chan error, 2)
+	go func() {
+		var err error
+		sent, err = pipe(upstream, client, &lastActivity, idleTimeout)
+		done <- err
+	}()
+	go func() {
+		var err error
+		received, err = pipe(client, upstream, &lastActivity, idleTimeout)
+		done <- err
+	}()
+
+	// A clean EOF half-closes the other side, any other error tears down both connections.
+	if err := <-done; err != nil {
+		client.Close()
+		upstream.Close()
+	}
+	<-done
+	return sent, received
+}
+
+func pipe(dst, src net.Conn, lastActivity *atomic.Int64, idleTimeout time.Duration) (int64, error) {
+	var written int64
+	buf := make([]byte, tcpBufferSize)
+	for {
+		src.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, io.EOF) {
+			if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+				tcp.CloseWrite()
+			}
+			return written, nil
+		}
+		// The other direction may still be active.
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, lastActivity.Load())) < idleTimeout {
+			continue
+		}
+		return written, err
+	}
+}
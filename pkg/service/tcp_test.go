@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/config"
+	"vgo-balancer/pkg/proxyproto"
+
+	"go.uber.org/zap"
+)
+
+// tcpEcho runs a backend echoing every connection, until the test ends. The PROXY protocol
+// headers received are sent to headers when it isn't nil.
+func tcpEcho(t *testing.T, headers chan<- *proxyproto.Header) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if headers != nil {
+					h, err := proxyproto.ReadHeader(r)
+					if err != nil {
+						return
+					}
+					headers <- h
+				}
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startTCPService serves the tcp service on a localhost port until the test ends or the context is
+// done, and returns it with its address.
+func startTCPService(t *testing.T, parent context.Context, cfg *config.Service) (*Service, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(parent)
+	t.Cleanup(cancel)
+	svc, err := NewService(cfg, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.serve(func() { svc.ServeTCP(listener) })
+	return svc, listener.Addr().String()
+}
+
+// echo sends a message on a new connection to addr, and checks it comes back.
+func echo(t *testing.T, addr, msg string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	// The half-close reaches the backend, which ends the connection after echoing.
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != msg {
+		t.Errorf("reply = %q, want %q", reply, msg)
+	}
+}
+
+func TestTCPSplice(t *testing.T) {
+	_, addr := startTCPService(t, context.Background(), &config.Service{
+		Name:     "db",
+		Mode:     ModeTCP,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: "tcp://" + tcpEcho(t, nil)}},
+	})
+	echo(t, addr, "hello")
+	echo(t, addr, "a longer message going through the balancer")
+}
+
+func TestTCPFailover(t *testing.T) {
+	// Nothing listens on the first backend.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	_, addr := startTCPService(t, context.Background(), &config.Service{
+		Name:   "db",
+		Mode:   ModeTCP,
+		Listen: "127.0.0.1:0",
+		Backends: []config.Backend{
+			{URL: "tcp://" + closed.Addr().String()},
+			{URL: "tcp://" + tcpEcho(t, nil)},
+		},
+	})
+	for i := 0; i < 4; i++ {
+		echo(t, addr, "hello")
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	headers := make(chan *proxyproto.Header, 1)
+	_, addr := startTCPService(t, context.Background(), &config.Service{
+		Name:     "db",
+		Mode:     ModeTCP,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: "tcp://" + tcpEcho(t, headers), ProxyProtocol: proxyproto.Version2}},
+	})
+	echo(t, addr, "hello")
+
+	// The backend learns the address of the client.
+	h := <-headers
+	if h.Version != proxyproto.Version2 || h.Destination.String() != addr {
+		t.Errorf("header = %+v, want a v2 header to %s", h, addr)
+	}
+	if ip := h.Source.(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("source = %s, want the client", h.Source)
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	_, addr := startTCPService(t, context.Background(), &config.Service{
+		Name:        "db",
+		Mode:        ModeTCP,
+		Listen:      "127.0.0.1:0",
+		IdleTimeout: 100 * time.Millisecond,
+		Backends:    []config.Backend{{URL: "tcp://" + tcpEcho(t, nil)}},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A connection without traffic is closed after the idle timeout.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read error = %v, want the connection closed", err)
+	}
+}
+
+// roundTrip sends a message on the connection, and checks it comes back.
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != msg {
+		t.Errorf("reply = %q, want %q", reply, msg)
+	}
+}
+
+// waitRefused waits until the address refuses connections.
+func waitRefused(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("connections still accepted after the shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPShutdownDrains(t *testing.T) {
+	svc, addr := startTCPService(t, context.Background(), &config.Service{
+		Name:     "db",
+		Mode:     ModeTCP,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: "tcp://" + tcpEcho(t, nil)}},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "before")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- svc.Shutdown(ctx) }()
+
+	// New connections are refused while the connection in progress is served.
+	waitRefused(t, addr)
+	roundTrip(t, conn, "during")
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned %v with a connection in progress", err)
+	default:
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("shutdown error = %v, want the connections drained", err)
+	}
+}
+
+func TestTCPShutdownTimeout(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	svc, addr := startTCPService(t, ctx, &config.Service{
+		Name:     "db",
+		Mode:     ModeTCP,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: "tcp://" + tcpEcho(t, nil)}},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := svc.Shutdown(timeout); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown error = %v, want the deadline exceeded", err)
+	}
+
+	// The connections left are cut once the service is stopped.
+	stop()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read error = %v, want the connection closed", err)
+	}
+}
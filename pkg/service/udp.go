@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	bc "vgo-balancer/pkg/backend"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultUDPSessionTimeout = 30 * time.Second
+	udpBufferSize            = 64 * 1024
+	udpMaxPending            = 32 // bounds the datagrams queued for a client while its session is created.
+)
+
+// UDPStats are the traffic counters of a backend of a udp service.
+type UDPStats struct {
+	Sessions       atomic.Int64 // Sessions is the number of sessions created.
+	ActiveSessions atomic.Int64 // ActiveSessions is the number of sessions not timed out yet.
+	PacketsIn      atomic.Int64 // PacketsIn is the number of packets sent by the clients.
+	PacketsOut     atomic.Int64 // PacketsOut is the number of packets replied by the backend.
+	BytesIn        atomic.Int64 // BytesIn is the number of bytes sent by the clients.
+	BytesOut       atomic.Int64 // BytesOut is the number of bytes replied by the backend.
+}
+
+// UDPCounters are the values of the traffic counters of a backend of a udp service.
+type UDPCounters struct {
+	Sessions       int64 `json:"sessions"`
+	ActiveSessions int64 `json:"active_sessions"`
+	PacketsIn      int64 `json:"packets_in"`
+	PacketsOut     int64 `json:"packets_out"`
+	BytesIn        int64 `json:"bytes_in"`
+	BytesOut       int64 `json:"bytes_out"`
+}
+
+// Counters returns the current values of the stats.
+func (st *UDPStats) Counters() UDPCounters {
+	return UDPCounters{
+		Sessions:       st.Sessions.Load(),
+		ActiveSessions: st.ActiveSessions.Load(),
+		PacketsIn:      st.PacketsIn.Load(),
+		PacketsOut:     st.PacketsOut.Load(),
+		BytesIn:        st.BytesIn.Load(),
+		BytesOut:       st.BytesOut.Load(),
+	}
+}
+
+// udpSession binds a client address to a backend until no packet went through for the session
+// timeout, so that the replies of the backend reach the right client.
+type udpSession struct {
+	client       *net.UDPAddr
+	backend      *bc.Backend
+	upstream     *net.UDPConn
+	stats        *UDPStats
+	lastActivity atomic.Int64
+}
+
+// udpProxy holds the sessions and the per backend stats of a udp service.
+type udpProxy struct {
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	pending  map[string][][]byte // pending are the datagrams of the clients whose session is being created.
+	stats    sync.Map            // map[*bc.Backend]*UDPStats
+	draining bool                // draining is set when the service shuts down, new clients are dropped.
+	drained  chan struct{}       // drained is closed once the sessions ended after the shutdown.
+}
+
+// ServeUDP reads the datagrams received on the listen address of the service and forwards them
+// to the backend of the session of their client, until the service shuts down. The sessions in
+// progress are served until they time out.
+func (s *Service) ServeUDP(conn *net.UDPConn) {
+	go func() {
+		select {
+		case <-s.closing:
+			s.udp.mu.Lock()
+			s.udp.draining = true
+			s.checkUDPDrained()
+			s.udp.mu.Unlock()
+			select {
+			case <-s.udp.drained:
+			case <-s.Ctx.Done():
+			}
+		case <-s.Ctx.Done():
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.Ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				s.Logger.Info("UDP listener stopped", zap.String("address", s.Listen))
+				return
+			}
+			s.Logger.Warn("Failed to read UDP datagram", zap.Error(err))
+			continue
+		}
+
+		if session := s.udpSession(conn, client, buf[:n]); session != nil {
+			s.forwardUDP(session, buf[:n])
+		}
+	}
+}
+
+// udpSession returns the session of the client. The session of a new client is created in the
+// background, so that resolving and connecting to its backend doesn't hold up the datagrams of the
+// other clients, and its datagrams are queued until then.
+func (s *Service) udpSession(listener *net.UDPConn, client *net.UDPAddr, datagram []byte) *udpSession {
+	key := client.String()
+	s.udp.mu.Lock()
+	defer s.udp.mu.Unlock()
+
+	if session, ok := s.udp.sessions[key]; ok {
+		return session
+	}
+	queued, creating := s.udp.pending[key]
+	if s.udp.draining && !creating {
+		return nil
+	}
+	if len(queued) < udpMaxPending {
+		s.udp.pending[key] = append(queued, append([]byte(nil), datagram...))
+	}
+	if !creating {
+		go s.createUDPSession(listener, client)
+	}
+	return nil
+}
+
+// createUDPSession creates the session of a new client, forwards the datagrams queued meanwhile
+// and then publishes the session, so that the datagrams of the client keep their order.
+func (s *Service) createUDPSession(listener *net.UDPConn, client *net.UDPAddr) {
+	key := client.String()
+	session := s.dialUDPSession(client)
+	for {
+		s.udp.mu.Lock()
+		queued := s.udp.pending[key]
+		if session == nil || len(queued) == 0 {
+			delete(s.udp.pending, key)
+			if session != nil {
+				s.udp.sessions[key] = session
+			}
+			s.checkUDPDrained()
+			s.udp.mu.Unlock()
+			if session != nil {
+				// The replies to the queued datagrams wait in the buffer of the socket.
+				go s.forwardUDPReplies(listener, session)
+			}
+			return
+		}
+		s.udp.pending[key] = nil
+		s.udp.mu.Unlock()
+
+		for _, datagram := range queued {
+			s.forwardUDP(session, datagram)
+		}
+	}
+}
+
+// dialUDPSession connects a new client to a backend selected by the algorithm.
+func (s *Service) dialUDPSession(client *net.UDPAddr) *udpSession {
+	be := s.Algo.NextBackend(s.BEPool.GetBackends(), nil, nil)
+	if be == nil {
+		s.Logger.Error("Failed to select backend, No available backend found.", zap.String("client", client.String()))
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", be.URL.Host)
+	if err != nil {
+		s.Logger.Warn("Failed to resolve the backend", zap.String("backend", be.URL.String()), zap.Error(err))
+		return nil
+	}
+	upstream, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		s.Logger.Warn("Failed to connect to the backend", zap.String("backend", be.URL.String()), zap.Error(err))
+		return nil
+	}
+
+	session := &udpSession{client: client, backend: be, upstream: upstream, stats: s.BackendUDPStats(be)}
+	session.lastActivity.Store(time.Now().UnixNano())
+	session.stats.Sessions.Add(1)
+	session.stats.ActiveSessions.Add(1)
+	be.Inflight.Add(1)
+	return session
+}
+
+// forwardUDP sends a datagram of the client to the backend of its session.
+func (s *Service) forwardUDP(session *udpSession, datagram []byte) {
+	session.lastActivity.Store(time.Now().UnixNano())
+	session.stats.PacketsIn.Add(1)
+	session.stats.BytesIn.Add(int64(len(datagram)))
+	if _, err := session.upstream.Write(datagram); err != nil {
+		s.Logger.Warn("Failed to forward UDP datagram", zap.String("backend", session.backend.URL.String()), zap.Error(err))
+	}
+}
+
+// forwardUDPReplies sends the replies of the backend to the client of the session, and ends the
+// session once it timed out.
+func (s *Service) forwardUDPReplies(listener *net.UDPConn, session *udpSession) {
+	// The sessions still open when the service context is done are cut.
+	stop := context.AfterFunc(s.Ctx, func() { session.upstream.Close() })
+	defer stop()
+	defer func() {
+		s.udp.mu.Lock()
+		delete(s.udp.sessions, session.client.String())
+		s.checkUDPDrained()
+		s.udp.mu.Unlock()
+
+		session.upstream.Close()
+		session.stats.ActiveSessions.Add(-1)
+		session.backend.Inflight.Add(-1)
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		session.upstream.SetReadDeadline(time.Unix(0, session.lastActivity.Load()).Add(s.sessionTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			// Datagrams from the client extend the session.
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, session.lastActivity.Load())) < s.sessionTimeout {
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) && s.Ctx.Err() == nil {
+				s.Logger.Warn("UDP session failed", zap.String("backend", session.backend.URL.String()), zap.Error(err))
+			}
+			return
+		}
+
+		session.lastActivity.Store(time.Now().UnixNano())
+		session.stats.PacketsOut.Add(1)
+		session.stats.BytesOut.Add(int64(n))
+		if _, err := listener.WriteToUDP(buf[:n], session.client); err != nil {
+			s.Logger.Warn("Failed to send UDP reply", zap.String("client", session.client.String()), zap.Error(err))
+		}
+	}
+}
+
+// checkUDPDrained closes drained once no session is left after the shutdown. s.udp.mu must be held.
+func (s *Service) checkUDPDrained() {
+	if !s.udp.draining || len(s.udp.sessions) > 0 || len(s.udp.pending) > 0 {
+		return
+	}
+	select {
+	case <-s.udp.drained:
+	default:
+		close(s.udp.drained)
+	}
+}
+
+// BackendUDPStats returns the traffic counters of a backend of a udp service.
+func (s *Service) BackendUDPStats(b *bc.Backend) *UDPStats {
+	stats, _ := s.udp.stats.LoadOrStore(b, &UDPStats{})
+	return stats.(*UDPStats)
+}
+
+// udpCounters returns the traffic counters of a backend of a udp service, zero when no client
+// was sent to it yet.
+func (s *Service) udpCounters(b *bc.Backend) UDPCounters {
+	if stats, ok := s.udp.stats.Load(b); ok {
+		return stats.(*UDPStats).Counters()
+	}
+	return UDPCounters{}
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vgo-balancer/pkg/algo"
+	bc "vgo-balancer/pkg/backend"
+	"vgo-balancer/pkg/config"
+
+	"go.uber.org/zap"
+)
+
+// udpEcho runs a backend replying to every datagram with its content, until the test ends.
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startUDPService serves the udp service on a localhost port until the test ends, and returns
+// its address. The setup functions modify the service before it starts.
+func startUDPService(t *testing.T, cfg *config.Service, setup ...func(*Service)) (*Service, *net.UDPAddr) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	svc, err := NewService(cfg, ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range setup {
+		f(svc)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.serve(func() { svc.ServeUDP(conn) })
+	return svc, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func exchange(t *testing.T, conn *net.UDPConn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != msg {
+		t.Errorf("reply = %q, want %q", got, msg)
+	}
+}
+
+func udpStatus(svc *Service) map[string]UDPCounters {
+	counters := make(map[string]UDPCounters)
+	for _, status := range svc.HealthStatus() {
+		if status.UDP != nil {
+			counters[status.Backend] = *status.UDP
+		}
+	}
+	return counters
+}
+
+func TestUDPSessions(t *testing.T) {
+	backends := []config.Backend{{URL: "udp://" + udpEcho(t)}, {URL: "udp://" + udpEcho(t)}}
+	svc, addr := startUDPService(t, &config.Service{
+		Name:           "dns",
+		Mode:           ModeUDP,
+		Listen:         "127.0.0.1:0",
+		SessionTimeout: 200 * time.Millisecond,
+		Backends:       backends,
+	})
+
+	// Every datagram of a client goes to the backend of its session.
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exchange(t, client, "ping")
+	exchange(t, client, "pong!")
+
+	counters := udpStatus(svc)
+	if len(counters) != 2 {
+		t.Fatalf("stats of %d backends, want 2", len(counters))
+	}
+	var active UDPCounters
+	for _, c := range counters {
+		if c.Sessions > 0 {
+			active = c
+		}
+	}
+	want := UDPCounters{Sessions: 1, ActiveSessions: 1, PacketsIn: 2, PacketsOut: 2, BytesIn: 9, BytesOut: 9}
+	if active != want {
+		t.Errorf("stats = %+v, want %+v", active, want)
+	}
+
+	// The session ends once no datagram went through for the session timeout.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var sessions int64
+		for _, c := range udpStatus(svc) {
+			sessions += c.ActiveSessions
+		}
+		if sessions == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not ended after the session timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The stats of the backends removed from the pool are dropped.
+	svc.UpdateBackends(backends[:1])
+	if counters := udpStatus(svc); len(counters) != 1 {
+		t.Errorf("stats of %d backends after the update, want 1", len(counters))
+	}
+	svc.udp.stats.Range(func(key, _ interface{}) bool {
+		if svc.BEPool.GetBackends()[0] != key {
+			t.Errorf("stats kept for a removed backend")
+		}
+		return true
+	})
+}
+
+// blockingAlgorithm holds the first selection until released, like a backend slow to resolve.
+type blockingAlgorithm struct {
+	algo.Algorithm
+	first   atomic.Bool
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingAlgorithm) NextBackend(pool []*bc.Backend, w http.ResponseWriter, r *http.Request) *bc.Backend {
+	if a.first.CompareAndSwap(false, true) {
+		close(a.blocked)
+		<-a.release
+	}
+	return a.Algorithm.NextBackend(pool, w, r)
+}
+
+func TestUDPSessionCreationDoesNotBlock(t *testing.T) {
+	var blocking *blockingAlgorithm
+	_, addr := startUDPService(t, &config.Service{
+		Name:     "dns",
+		Mode:     ModeUDP,
+		Listen:   "127.0.0.1:0",
+		Backends: []config.Backend{{URL: "udp://" + udpEcho(t)}},
+	}, func(svc *Service) {
+		blocking = &blockingAlgorithm{Algorithm: svc.Algo, blocked: make(chan struct{}), release: make(chan struct{})}
+		svc.Algo = blocking
+	})
+
+	slow, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := slow.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-blocking.blocked
+
+	// Other clients are served while the session of the first one is being created.
+	fast, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	exchange(t, fast, "ping")
+
+	// The datagrams queued meanwhile are forwarded in order.
+	close(blocking.release)
+	buf := make([]byte, 64)
+	for _, want := range []string{"one", "two", "three"} {
+		slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := slow.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("reply = %q, want %q", got, want)
+		}
+	}
+	exchange(t, slow, "four")
+}
+
+func TestUDPShutdownDrains(t *testing.T) {
+	svc, addr := startUDPService(t, &config.Service{
+		Name:           "dns",
+		Mode:           ModeUDP,
+		Listen:         "127.0.0.1:0",
+		SessionTimeout: 300 * time.Millisecond,
+		Backends:       []config.Backend{{URL: "udp://" + udpEcho(t)}},
+	})
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exchange(t, client, "before")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- svc.Shutdown(ctx) }()
+	for draining := false; !draining; time.Sleep(time.Millisecond) {
+		svc.udp.mu.Lock()
+		draining = svc.udp.draining
+		svc.udp.mu.Unlock()
+	}
+
+	// The session in progress is served, new clients aren't.
+	exchange(t, client, "during")
+	other, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write([]byte("new"))
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := other.Read(make([]byte, 64)); err == nil {
+		t.Errorf("new client answered with %d bytes during the shutdown", n)
+	}
+
+	// The shutdown completes once the session timed out.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shutdown error = %v, want the sessions drained", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown not completed after the session timeout")
+	}
+}